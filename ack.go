@@ -0,0 +1,352 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Acknowledgement module
+
+package tru
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxAckRanges = 32 // Max number of SACK ranges in ack packet
+
+// Ack data layout version and flags
+const (
+	ackDataVersion = 1 // Ack data layout version
+
+	ackFlagWindow = 1 << 0 // Ack data has receive window
+)
+
+// Default ack policy
+const (
+	defaultAckFrequency = 2
+	defaultAckDelay     = 5 * time.Millisecond
+)
+
+// AckPolicy parameter type sets channels acknowledgement frequency. The ack
+// is sent after Frequency data packets received or after Delay time since
+// first not acknowledged packet received, whichever first. Out of order and
+// duplicate packets acknowledged immediately. Zero values set defaults. Each
+// packet from protocol version 5 peer acknowledged immediately.
+type AckPolicy struct {
+	Frequency int           // Number of received packets acknowledged by one ack
+	Delay     time.Duration // Max acknowledgement delay
+}
+
+// acker is channels delayed acknowledgement state
+type acker struct {
+	pending int         // Number of received and not acknowledged packets
+	id      int         // Last received packet id
+	time    time.Time   // Last received packet time
+	timer   *time.Timer // Ack delay timer
+	window  uint32      // Last advertised receive window
+	sync.Mutex
+}
+
+// ackPacketData is statusAck packet data. It contains cumulative
+// acknowledgement (all packets with id less than expectedID received),
+// selective acknowledgement (SACK) ranges of packets received out of order
+// and saved in receive queue, and free receive window.
+type ackPacketData struct {
+	expectedID uint32     // Next expected ID, all previouse packets received
+	delay      uint32     // Ack delay in microseconds
+	ranges     []ackRange // Out of order received packets ranges
+	window     uint32     // Receive window in packets
+}
+
+// ackRange is range of received packets id, first and last id included
+type ackRange struct {
+	first uint32
+	last  uint32
+}
+
+// MarshalBinary marshal ack data
+//
+//	Binary ack data structure:
+//	+---------------+-------------+--------------------+------------------+
+//	| VERSION uint8 | FLAGS uint8 | EXPECTED ID uint32 | ACK DELAY uint32 |
+//	+---------------+-------------+--------------------+------------------+
+//	+-----------------+--------+---------------+
+//	| NUM RANGE uint8 | RANGES | WINDOW uint32 |
+//	+-----------------+--------+---------------+
+//	VERSION: ack data layout version, changed when layout is not compatible
+//	FLAGS: optional fields present in ack data
+//	RANGES: NUM RANGE pairs of FIRST uint32, LAST uint32
+//	WINDOW: present when ackFlagWindow set
+//	Data after known fields ignored, so new optional fields may be added
+//	with new flags
+func (a *ackPacketData) MarshalBinary() (out []byte, err error) {
+	buf := new(bytes.Buffer)
+	le := binary.LittleEndian
+
+	var flags uint8
+	if a.window != ackNoWindow {
+		flags |= ackFlagWindow
+	}
+	binary.Write(buf, le, uint8(ackDataVersion))
+	binary.Write(buf, le, flags)
+	binary.Write(buf, le, a.expectedID)
+	binary.Write(buf, le, a.delay)
+	binary.Write(buf, le, uint8(len(a.ranges)))
+	for _, r := range a.ranges {
+		binary.Write(buf, le, r.first)
+		binary.Write(buf, le, r.last)
+	}
+	if flags&ackFlagWindow != 0 {
+		binary.Write(buf, le, a.window)
+	}
+
+	out = buf.Bytes()
+	return
+}
+
+// UnmarshalBinary unmarshal ack data
+func (a *ackPacketData) UnmarshalBinary(data []byte) (err error) {
+
+	buf := bytes.NewReader(data)
+	le := binary.LittleEndian
+
+	var version, flags uint8
+	err = binary.Read(buf, le, &version)
+	if err != nil {
+		return
+	}
+	if version != ackDataVersion {
+		err = errors.New("wrong ack data version")
+		return
+	}
+	err = binary.Read(buf, le, &flags)
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(buf, le, &a.expectedID)
+	if err != nil {
+		return
+	}
+	err = binary.Read(buf, le, &a.delay)
+	if err != nil {
+		return
+	}
+
+	var l uint8
+	err = binary.Read(buf, le, &l)
+	if err != nil {
+		return
+	}
+	if buf.Len() < int(l)*8 {
+		err = errors.New("wrong ack ranges length")
+		return
+	}
+
+	a.ranges = make([]ackRange, l)
+	for i := range a.ranges {
+		binary.Read(buf, le, &a.ranges[i].first)
+		binary.Read(buf, le, &a.ranges[i].last)
+	}
+
+	// Receive window
+	a.window = ackNoWindow
+	if flags&ackFlagWindow != 0 {
+		err = binary.Read(buf, le, &a.window)
+	}
+
+	return
+}
+
+// highest return highest selective acknowledged id, ok is false if there is
+// not SACK ranges in ack data
+func (a *ackPacketData) highest() (id uint32, ok bool) {
+	if len(a.ranges) == 0 {
+		return
+	}
+	return a.ranges[len(a.ranges)-1].last, true
+}
+
+// ranges return sorted ranges of packets id in receive queue. The ids sorted
+// by distance from expectedID, number of ranges limited by max parameter
+func (r *receiveQueue) ranges(expectedID uint32, max int) (ranges []ackRange) {
+	r.RLock()
+	ids := make([]uint32, 0, len(r.ma))
+	for id := range r.ma {
+		if r.seq.distance(expectedID, id) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	r.RUnlock()
+
+	sort.Slice(ids, func(i, j int) bool {
+		return r.seq.distance(expectedID, ids[i]) < r.seq.distance(expectedID, ids[j])
+	})
+
+	for _, id := range ids {
+		if l := len(ranges); l > 0 && r.seq.distance(ranges[l-1].last, id) == 1 {
+			ranges[l-1].last = id
+			continue
+		}
+		if len(ranges) == max {
+			break
+		}
+		ranges = append(ranges, ackRange{id, id})
+	}
+
+	return
+}
+
+// ackReceived acknowledge received data packet. The ack is sent immediately
+// or delayed depending of channels ack policy
+func (ch *Channel) ackReceived(pac *Packet, immediately bool) {
+	policy := ch.tru.ackPolicy
+
+	// Protocol version 5 peers process packet id from ack header only, so
+	// each packet acknowledged immediately by ack without data
+	if ch.header.version < protocolVersion6 {
+		ch.writeTo(nil, statusAck, nil, pac.ID())
+		return
+	}
+
+	ch.ack.Lock()
+	ch.ack.pending++
+	ch.ack.id = pac.ID()
+	ch.ack.time = time.Now()
+	if !immediately && ch.ack.pending < policy.Frequency {
+		if ch.ack.timer == nil {
+			ch.ack.timer = time.AfterFunc(policy.Delay, ch.ackFlush)
+		}
+		ch.ack.Unlock()
+		return
+	}
+	ch.ack.Unlock()
+
+	ch.ackFlush()
+}
+
+// ackFlush send ack to last received packets if there is pending
+// acknowledgements
+func (ch *Channel) ackFlush() {
+	ch.ack.Lock()
+	if ch.ack.timer != nil {
+		ch.ack.timer.Stop()
+		ch.ack.timer = nil
+	}
+	if ch.ack.pending == 0 {
+		ch.ack.Unlock()
+		return
+	}
+	ch.ack.pending = 0
+	id, delay := ch.ack.id, time.Since(ch.ack.time)
+	ch.ack.Unlock()
+
+	ch.writeToAck(id, delay)
+}
+
+// ackDestroy stop ack delay timer
+func (ch *Channel) ackDestroy() {
+	ch.ack.Lock()
+	defer ch.ack.Unlock()
+
+	if ch.ack.timer != nil {
+		ch.ack.timer.Stop()
+		ch.ack.timer = nil
+	}
+}
+
+// writeToAck writes ack packet to channel. Ack packet header contains id of
+// last received packet, and ack packet data contains ack delay, cumulative
+// acknowledgement, SACK ranges and receive window
+func (ch *Channel) writeToAck(id int, delay time.Duration) (err error) {
+	expectedID := ch.getExpectedID()
+	ack := ackPacketData{
+		expectedID: expectedID,
+		delay:      uint32(delay.Microseconds()),
+		ranges:     ch.recvQueue.ranges(expectedID, maxAckRanges),
+		window:     ch.receiveWindow(),
+	}
+	ch.ack.Lock()
+	ch.ack.window = ack.window
+	ch.ack.Unlock()
+
+	data, err := ack.MarshalBinary()
+	if err != nil {
+		return
+	}
+	_, err = ch.writeTo(data, statusAck, nil, id)
+	return
+}
+
+// serveAck process received ack packet
+func (ch *Channel) serveAck(pac *Packet) {
+
+	// Ack packet from previous versions has not ack data
+	var ack ackPacketData
+	var sack = len(pac.Data()) > 0
+	if sack {
+		if err := ack.UnmarshalBinary(pac.Data()); err != nil {
+			log.Debugv.Println("got wrong ack data:", err)
+			sack = false
+		}
+	}
+
+	// Process packet with id from ack header
+	ackDelay := time.Duration(ack.delay) * time.Microsecond
+	tt, err := ch.setTripTime(pac.ID(), ackDelay)
+	if err != nil {
+		ch.stat.setAckDropReceived()
+	} else {
+		ch.stat.setAckReceived()
+		log.Debugvv.Printf("got ack to packet id %d, trip time: %.3f ms",
+			pac.ID(), float64(tt.Microseconds())/1000.0)
+		if p, ok := ch.sendQueue.delete(pac.ID()); ok {
+			ch.tru.retransmit.cancel(p)
+			ch.congestion().OnAck(len(p.data), tt)
+			ch.delivered(p)
+		}
+	}
+
+	// Delete packets acknowledged by cumulative ack and SACK ranges from send
+	// queue. Ack packet from previous versions acknowledged only packet from
+	// ack header, so packets sent before it are holes
+	var acked, holes []*Packet
+	if sack {
+		ch.sendQueue.setWindow(ack.window)
+		acked, holes = ch.sendQueue.ack(&ack)
+	} else if err == nil {
+		holes = ch.sendQueue.ackHoles(uint32(pac.ID()))
+	}
+	ch.tru.retransmit.cancel(acked...)
+	for _, p := range acked {
+		ch.congestion().OnAck(len(p.data), 0)
+		ch.delivered(p)
+	}
+
+	// Fast retransmit holes, but not more than once per trip time
+	tt = ch.getTripTime()
+	for _, p := range holes {
+		if time.Since(p.getTime()) < tt {
+			continue
+		}
+		log.Debugvv.Println("fast retransmit hole, id", p.ID())
+		ch.fastResend(p)
+	}
+
+	// Send pending packets when congestion window opened
+	ch.sendQueue.flush(ch)
+}
+
+// delivered execute packet delivery callback if delivery timeout callback
+// does not executed yet
+func (ch *Channel) delivered(pac *Packet) {
+	delivery := pac.Delivery()
+	if delivery == nil || !pac.deliveryDone.CompareAndSwap(false, true) {
+		return
+	}
+	pac.deliveryTimer.Stop()
+	go delivery(pac, nil)
+}
@@ -0,0 +1,203 @@
+package tru
+
+import (
+	"container/list"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+// ackConn is udp connection which counts sent ack packets
+type ackConn struct {
+	net.PacketConn
+	acks     atomic.Int32 // Number of sent ack packets
+	dataAcks atomic.Int32 // Number of sent ack packets with ack data
+}
+
+// WriteTo write packet and count ack packets
+func (c *ackConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+	pac := new(Packet)
+	if pac.unmarshalHeader(data) == nil && pac.Status() == statusAck {
+		c.acks.Add(1)
+		if len(pac.Data()) > 0 {
+			c.dataAcks.Add(1)
+		}
+	}
+	return c.PacketConn.WriteTo(data, addr)
+}
+
+func TestAckVersion5(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	const numPackets = 20
+	received := make(chan struct{}, numPackets)
+	reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+		if err == nil {
+			received <- struct{}{}
+		}
+		return
+	}
+
+	// Version 5 peer acknowledges each packet by ack without data
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconn := &ackConn{PacketConn: conn}
+	server, err := New(0, reader, sconn, ProtocolVersion(protocolVersion5),
+		LegacyHandshake(true), AckPolicy{Frequency: 10, Delay: time.Second}, log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+
+	client, err := New(0, LegacyHandshake(true), log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+
+	ch, err := client.Connect(sconn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("can't connect to server, err: %s", err)
+	}
+	for i := 0; i < numPackets; i++ {
+		if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+			t.Fatalf("WriteTo err: %s", err)
+		}
+	}
+	for i := 0; i < numPackets; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d packets from %d", i, numPackets)
+		}
+	}
+	for i := 0; ch.sendQueue.len() > 0; i++ {
+		if i == 100 {
+			t.Fatal("packets not acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := sconn.acks.Load(); n < numPackets || sconn.dataAcks.Load() != 0 {
+		t.Errorf("wrong acks to version 5 peer: %d, with data %d", n,
+			sconn.dataAcks.Load())
+	}
+}
+
+func TestAckPacketData(t *testing.T) {
+
+	ack := ackPacketData{
+		expectedID: 10,
+		delay:      1500,
+		ranges:     []ackRange{{12, 14}, {17, 17}, {packetIDLimit - 1, 2}},
+		window:     512,
+	}
+	data, err := ack.MarshalBinary()
+	if err != nil {
+		t.Errorf("can't marshal ack data, err: %s", err)
+		return
+	}
+
+	var out ackPacketData
+	err = out.UnmarshalBinary(data)
+	if err != nil {
+		t.Errorf("can't unmarshal ack data, err: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(ack, out) {
+		t.Errorf("wrong unmarshalled ack data: %v", out)
+	}
+
+	// Ack data without window
+	ack.window = ackNoWindow
+	data2, _ := ack.MarshalBinary()
+	err = out.UnmarshalBinary(data2)
+	if err != nil || len(data2) != len(data)-4 || out.window != ackNoWindow {
+		t.Errorf("wrong unmarshalled ack data without window: %v, err: %v", out, err)
+	}
+
+	// Unknown fields at the end of ack data ignored
+	err = out.UnmarshalBinary(append(data2, 1, 2, 3))
+	if err != nil || !reflect.DeepEqual(ack, out) {
+		t.Errorf("wrong unmarshalled ack data with new fields: %v, err: %v", out, err)
+	}
+
+	// Wrong window and ranges length, and unknown version
+	for _, d := range [][]byte{
+		data[:len(data)-1],
+		data[:len(data)-5],
+		append([]byte{ackDataVersion + 1}, data[1:]...),
+	} {
+		if err = out.UnmarshalBinary(d); err == nil {
+			t.Errorf("unmarshal wrong ack data without error")
+		}
+	}
+}
+
+func TestAckRanges(t *testing.T) {
+
+	var r receiveQueue
+	r.init(nil)
+	for _, id := range []uint32{3, 5, 6, 7, 9, 1, 2} {
+		r.ma[id] = &Packet{id: id}
+	}
+
+	ranges := r.ranges(3, maxAckRanges)
+	expected := []ackRange{{5, 7}, {9, 9}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("wrong ranges: %v, expected: %v", ranges, expected)
+	}
+
+	ranges = r.ranges(3, 1)
+	if len(ranges) != 1 {
+		t.Errorf("wrong number of limited ranges: %v", ranges)
+	}
+}
+
+func TestSendQueueAck(t *testing.T) {
+
+	if log == nil {
+		log = teolog.New()
+	}
+
+	var s sendQueue
+	s.index = make(map[uint32]*list.Element)
+	for id := 0; id < 10; id++ {
+		s.add(&Packet{id: uint32(id)})
+	}
+
+	// Cumulative ack 0-2 and SACK ranges 4-5, 7
+	ack := &ackPacketData{3, 0, []ackRange{{4, 5}, {7, 7}}, ackNoWindow}
+	acked, holes := s.ack(ack)
+	if len(acked) != 6 {
+		t.Errorf("wrong number of acked packets: %d", len(acked))
+	}
+
+	// Holes returned after fast retransmit threshold acks
+	for i := 1; i < fastRetransmitThreshold; i++ {
+		if len(holes) != 0 {
+			t.Errorf("holes returned before threshold: %d", len(holes))
+		}
+		acked, holes = s.ack(ack)
+	}
+	if len(acked) != 0 {
+		t.Errorf("wrong number of acked packets: %d", len(acked))
+	}
+	var holesID []int
+	for _, pac := range holes {
+		holesID = append(holesID, pac.ID())
+	}
+	if !reflect.DeepEqual(holesID, []int{3, 6}) {
+		t.Errorf("wrong holes: %v", holesID)
+	}
+	if s.len() != 4 {
+		t.Errorf("wrong send queue length: %d", s.len())
+	}
+}
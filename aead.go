@@ -0,0 +1,330 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Packet AEAD module
+
+package tru
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/cpu"
+)
+
+// Protocol version 6 channels seal every data packet with AEAD. Client and
+// server send packets with its own keys derived from session key, packet
+// nonce is 64 bit packet number (id epoch and id) and packet header is
+// additional data, so packet id, status and connection id can't be changed.
+// Packet number never repeats during channel live, so nonce does not repeat
+// too. Retransmitted packets are sent sealed once and does not use new
+// nonce. Received packets which fail authentication are dropped as forged,
+// packets with already received packet number are dropped as duplicates by
+// channels replay window: packets with id less than expected id and packets
+// in receive queue already received. Protocol version 5 channels use legacy
+// packets encryption.
+
+// Cipher suite of packets AEAD negotiated in handshake. Client sends
+// supported cipher suites in preference order and server selects first
+// cipher suite it supports. Selected cipher suite is bound to handshake
+// transcript, so it can't be downgraded.
+
+// CipherSuite is packets AEAD cipher suite
+type CipherSuite uint8
+
+// Cipher suites
+const (
+	CipherSuiteLegacy           CipherSuite = iota // Protocol version 5 packets encryption
+	CipherSuiteAES256GCM                           // AES-256-GCM
+	CipherSuiteChaCha20Poly1305                    // ChaCha20-Poly1305
+)
+
+// CipherSuites parameter type set supported cipher suites in preference
+// order. By default AES-256-GCM preferred if AES hardware acceleration
+// available, and ChaCha20-Poly1305 preferred otherwise
+type CipherSuites []CipherSuite
+
+// ErrPacketAuth returned when received packet fails authentication
+var ErrPacketAuth = errors.New("packet authentication failed")
+
+// String return cipher suite name
+func (s CipherSuite) String() string {
+	switch s {
+	case CipherSuiteLegacy:
+		return "legacy"
+	case CipherSuiteAES256GCM:
+		return "AES-256-GCM"
+	case CipherSuiteChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// defaultCipherSuites return default cipher suites depend of AES hardware
+// acceleration
+func defaultCipherSuites() CipherSuites {
+	hasAESGCM := cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+		cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+		runtime.GOARCH == "arm64" && runtime.GOOS == "darwin" ||
+		cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	if hasAESGCM {
+		return CipherSuites{CipherSuiteAES256GCM, CipherSuiteChaCha20Poly1305}
+	}
+	return CipherSuites{CipherSuiteChaCha20Poly1305, CipherSuiteAES256GCM}
+}
+
+// check check cipher suites parameter and return it or default cipher suites
+// if empty
+func (suites CipherSuites) check() (CipherSuites, error) {
+	if len(suites) == 0 {
+		return defaultCipherSuites(), nil
+	}
+	for _, s := range suites {
+		if s != CipherSuiteAES256GCM && s != CipherSuiteChaCha20Poly1305 {
+			return nil, fmt.Errorf("unsupported cipher suite %v", s)
+		}
+	}
+	return suites, nil
+}
+
+// supports return true if cipher suite is in the list
+func (suites CipherSuites) supports(suite CipherSuite) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+// bytes return cipher suites list in bytes
+func (suites CipherSuites) bytes() []byte {
+	out := make([]byte, len(suites))
+	for i, s := range suites {
+		out[i] = uint8(s)
+	}
+	return out
+}
+
+// selectCipherSuite select first cipher suite of peers list supported by
+// tru. Peers without cipher suites option use AES-256-GCM
+func (tru *Tru) selectCipherSuite(suites CipherSuites) (CipherSuite, error) {
+	if len(suites) == 0 {
+		suites = CipherSuites{CipherSuiteAES256GCM}
+	}
+	for _, s := range suites {
+		if tru.cipherSuites.supports(s) {
+			return s, nil
+		}
+	}
+	return 0, errors.New("no supported cipher suite")
+}
+
+const (
+	packetKeyClient = "tru packet client" // Client send key label
+	packetKeyServer = "tru packet server" // Server send key label
+	packetKeyLen    = 32                  // AES-256 and ChaCha20 key length
+)
+
+// packetAEAD seals sent and opens received data packets. It keeps packet
+// keys of current keys generation and keys update state
+type packetAEAD struct {
+	suite      CipherSuite // Cipher suite
+	serverMode bool        // Server side keys
+	keys       *packetKeys // Current generation keys
+	prev       cipher.AEAD // Previous generation receive AEAD
+	next       *packetKeys // Next generation keys, created when needed
+	rekey      rekeyState  // Keys update state
+	sync.Mutex
+}
+
+// packetKeys is one generation packet keys
+type packetKeys struct {
+	secret []byte      // Generation secret
+	send   cipher.AEAD // Send packets AEAD
+	recv   cipher.AEAD // Receive packets AEAD
+}
+
+// newPacketAEAD create channels packet AEAD of cipher suite from session key
+func newPacketAEAD(sessionKey []byte, suite CipherSuite,
+	serverMode bool) (a *packetAEAD, err error) {
+
+	a = &packetAEAD{suite: suite, serverMode: serverMode}
+	a.keys, err = a.newPacketKeys(sessionKey)
+	a.rekey.time = time.Now()
+	return
+}
+
+// newPacketKeys create packet keys from generation secret
+func (a *packetAEAD) newPacketKeys(secret []byte) (k *packetKeys, err error) {
+	client, err := newPacketCipher(secret, a.suite, packetKeyClient)
+	if err != nil {
+		return
+	}
+	server, err := newPacketCipher(secret, a.suite, packetKeyServer)
+	if err != nil {
+		return
+	}
+	k = &packetKeys{secret: secret, send: client, recv: server}
+	if a.serverMode {
+		k.send, k.recv = server, client
+	}
+	return
+}
+
+// newPacketCipher derive key with label from session key and create cipher
+// suite AEAD
+func newPacketCipher(sessionKey []byte, suite CipherSuite,
+	label string) (aead cipher.AEAD, err error) {
+
+	key := make([]byte, packetKeyLen)
+	kdf := hkdf.New(sha256.New, sessionKey, nil, []byte(label))
+	if _, err = io.ReadFull(kdf, key); err != nil {
+		return
+	}
+	switch suite {
+	case CipherSuiteAES256GCM:
+		var block cipher.Block
+		block, err = aes.NewCipher(key)
+		if err != nil {
+			return
+		}
+		return cipher.NewGCM(block)
+	case CipherSuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	err = fmt.Errorf("unsupported cipher suite %v", suite)
+	return
+}
+
+// packetNonce return nonce of packet with id and id epoch
+func packetNonce(nonce *[12]byte, id, epoch uint32) []byte {
+	binary.BigEndian.PutUint32(nonce[4:], epoch)
+	binary.BigEndian.PutUint32(nonce[8:], id)
+	return nonce[:]
+}
+
+// seal encrypt and authenticate data and header by current send key, and
+// append result to dst
+func (a *packetAEAD) seal(dst, header, data []byte, id, epoch uint32) []byte {
+	var nonce [12]byte
+	return a.keys.send.Seal(dst, packetNonce(&nonce, id, epoch), data, header)
+}
+
+// sealPacket set packets key phase flag and seal packet data with packet
+// header
+func (a *packetAEAD) sealPacket(pac *Packet, epoch uint32, data []byte) []byte {
+	a.Lock()
+	defer a.Unlock()
+
+	pac.flags = pac.flags&^flagKeyPhase | a.phase()
+	var header [maxHeaderLen]byte
+	out := a.seal(nil, pac.appendHeader(header[:0]), data, pac.id, epoch)
+	a.sealed(packetNumber(pac.id, epoch), len(data))
+	return out
+}
+
+// open decrypt and authenticate data and header by receive key of packets
+// key phase, and append result to dst. Packet with other key phase opened by
+// previous keys if it was sent before peer updated keys, or by next keys if
+// peer updated keys
+func (a *packetAEAD) open(dst, header, data []byte, id, epoch uint32,
+	phase uint8) (out []byte, err error) {
+
+	a.Lock()
+	defer a.Unlock()
+
+	var nonce [12]byte
+	packetNonce(&nonce, id, epoch)
+	pn := packetNumber(id, epoch)
+	r := &a.rekey
+
+	switch {
+
+	// Current keys
+	case phase == a.phase():
+		out, err = a.keys.recv.Open(dst, nonce[:], data, header)
+		if err == nil && pn < r.recvFirst {
+			r.recvFirst = pn
+		}
+
+	// Previous keys
+	case a.prev != nil && pn < r.recvFirst:
+		out, err = a.prev.Open(dst, nonce[:], data, header)
+
+	// Next keys, peer updated keys
+	default:
+		var next *packetKeys
+		next, err = a.nextKeys()
+		if err != nil {
+			break
+		}
+		out, err = next.recv.Open(dst, nonce[:], data, header)
+		if err == nil {
+			a.update()
+			r.recvFirst = pn
+		}
+	}
+
+	if err != nil {
+		err = ErrPacketAuth
+	}
+	return
+}
+
+// setPacketKey set channels session key and create packet AEAD in protocol
+// version 6 channels
+func (ch *Channel) setPacketKey(key []byte) (err error) {
+	ch.setSesionKey(key)
+	if ch.header.version < protocolVersion6 {
+		return
+	}
+	ch.aead, err = newPacketAEAD(key, ch.header.suite, ch.serverMode)
+	return
+}
+
+// CipherSuite return channels packets cipher suite negotiated in handshake
+func (ch *Channel) CipherSuite() CipherSuite {
+	return ch.header.suite
+}
+
+// encryptPacket encrypt data of packet with id epoch. Protocol version 6
+// packets sealed with packet header
+func (ch *Channel) encryptPacket(pac *Packet, epoch uint32, data []byte) (out []byte, err error) {
+	if ch.header.version < protocolVersion6 {
+		return ch.encryptPacketData(pac.ID(), epoch, data)
+	}
+	if ch.aead == nil {
+		err = errors.New("channel key does not set")
+		return
+	}
+	ch.rekeyByPolicy()
+	out = ch.aead.sealPacket(pac, epoch, data)
+	return
+}
+
+// decryptPacket decrypt data of received packet with id epoch and append it
+// to dst. Protocol version 6 packets opened with received packet header
+func (ch *Channel) decryptPacket(dst, header []byte, pac *Packet,
+	epoch uint32) (out []byte, err error) {
+
+	if ch.header.version < protocolVersion6 {
+		return ch.decryptPacketData(dst, pac.ID(), epoch, pac.Data())
+	}
+	if ch.aead == nil {
+		err = ErrPacketAuth
+		return
+	}
+	return ch.aead.open(dst, header, pac.Data(), pac.id, epoch, pac.flags&flagKeyPhase)
+}
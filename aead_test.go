@@ -0,0 +1,154 @@
+package tru
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestPacketAEAD(t *testing.T) {
+	for _, suite := range []CipherSuite{CipherSuiteAES256GCM,
+		CipherSuiteChaCha20Poly1305} {
+		t.Run(suite.String(), func(t *testing.T) { testPacketAEAD(t, suite) })
+	}
+}
+
+func testPacketAEAD(t *testing.T, suite CipherSuite) {
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	client, err := newPacketAEAD(key, suite, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newPacketAEAD(key, suite, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := []byte{1, 2, 3, 4}
+	data := []byte("some test data")
+	sealed := client.seal(nil, header, data, 10, 1)
+
+	out, err := server.open(nil, header, sealed, 10, 1, 0)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("can't open packet, err: %v", err)
+	}
+
+	// Changed header, id, epoch and data fail authentication
+	if _, err = server.open(nil, []byte{1, 2, 3, 5}, sealed, 10, 1, 0); err != ErrPacketAuth {
+		t.Error("packet with changed header opened")
+	}
+	if _, err = server.open(nil, header, sealed, 11, 1, 0); err != ErrPacketAuth {
+		t.Error("packet with changed id opened")
+	}
+	if _, err = server.open(nil, header, sealed, 10, 2, 0); err != ErrPacketAuth {
+		t.Error("packet with changed epoch opened")
+	}
+	sealed[0] ^= 1
+	if _, err = server.open(nil, header, sealed, 10, 1, 0); err != ErrPacketAuth {
+		t.Error("packet with changed data opened")
+	}
+
+	// Packet reflected back to sender fails authentication
+	sealed = client.seal(nil, header, data, 10, 1)
+	if _, err = client.open(nil, header, sealed, 10, 1, 0); err != ErrPacketAuth {
+		t.Error("reflected packet opened")
+	}
+}
+
+func TestCipherSuiteNegotiation(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	aes, chacha := CipherSuiteAES256GCM, CipherSuiteChaCha20Poly1305
+	tests := []struct {
+		server, client CipherSuites
+		version        int
+		expected       CipherSuite
+		fail           bool
+	}{
+		{CipherSuites{aes, chacha}, CipherSuites{chacha, aes}, 0, chacha, false},
+		{CipherSuites{chacha, aes}, CipherSuites{aes, chacha}, 0, aes, false},
+		{CipherSuites{aes}, CipherSuites{chacha, aes}, 0, aes, false},
+		{CipherSuites{chacha}, CipherSuites{aes}, 0, 0, true},
+		{nil, nil, protocolVersion5, CipherSuiteLegacy, false},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("server %v client %v", test.server, test.client),
+			func(t *testing.T) {
+
+				received := make(chan *Channel, 1)
+				reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+					if err == nil {
+						received <- ch
+					}
+					return
+				}
+
+				legacy := LegacyHandshake(test.version == protocolVersion5)
+				server, err := New(0, reader, test.server, legacy, log)
+				if err != nil {
+					t.Fatalf("can't start server, err: %s", err)
+				}
+				defer server.Close()
+
+				client, err := New(0, test.client, ProtocolVersion(test.version),
+					legacy, log)
+				if err != nil {
+					t.Fatalf("can't start client, err: %s", err)
+				}
+				defer client.Close()
+
+				ch, err := client.Connect(server.LocalAddr().String())
+				if test.fail {
+					if err == nil {
+						t.Fatal("connected without common cipher suite")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("can't connect to server, err: %s", err)
+				}
+				if ch.CipherSuite() != test.expected {
+					t.Errorf("wrong client cipher suite %v", ch.CipherSuite())
+				}
+
+				if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+					t.Fatalf("WriteTo err: %s", err)
+				}
+				select {
+				case sch := <-received:
+					if sch.CipherSuite() != test.expected {
+						t.Errorf("wrong server cipher suite %v", sch.CipherSuite())
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("packet not received")
+				}
+			})
+	}
+
+	if _, err := New(0, CipherSuites{CipherSuiteLegacy}, log); err == nil {
+		t.Error("unsupported cipher suite accepted")
+	}
+}
+
+func BenchmarkPacketAEAD(b *testing.B) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	data := make([]byte, 1024)
+	for _, suite := range []CipherSuite{CipherSuiteAES256GCM,
+		CipherSuiteChaCha20Poly1305} {
+		b.Run(suite.String(), func(b *testing.B) {
+			a, _ := newPacketAEAD(key, suite, false)
+			out := make([]byte, 0, len(data)+16)
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				a.seal(out[:0], nil, data, uint32(i), 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Batch udp read and write module
+
+package tru
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// BatchIO parameter type switch batch udp read and write. Batch io uses
+// recvmmsg and sendmmsg system calls to read and write many udp packets by
+// one system call. It is switched on by default where supported (linux).
+//
+// Dual stack ipv6 socket, created by New with port by default, writes packets
+// to ipv4 peers by batch with ipv4-mapped ipv6 addresses.
+type BatchIO bool
+
+const (
+	batchSize     = 64        // Max number of packets in batch read and write
+	readBufferLen = 64 * 1024 // Read buffer length, max udp packet length
+)
+
+// batchConn is batch udp packets reader and writer, it implemented by
+// golang.org/x/net ipv4.PacketConn and by batchConn6 for ipv6 sockets
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// listenBatch read incoming udp packets by batches
+func (tru *Tru) listenBatch() {
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{*getBuffer(readBufferLen)}
+	}
+	defer func() {
+		for i := range msgs {
+			buf := msgs[i].Buffers[0]
+			putBuffer(&buf)
+		}
+	}()
+
+	for {
+		select {
+
+		// Check channel closed to stop listen and return
+		case _, ok := <-tru.listenStop:
+			if !ok {
+				log.Debug.Println("stop listen", tru.LocalAddr().String())
+				return
+			}
+
+		// Read batch of packets from tru connect (from UDP port)
+		default:
+			n, err := tru.batch.ReadBatch(msgs, 0)
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs[:n] {
+				if m.N > 0 {
+					tru.serve(m.N, m.Addr, m.Buffers[0][:m.N])
+				}
+			}
+		}
+	}
+}
+
+// batchable return true if packet to addr may be written by batch
+func (tru *Tru) batchable(addr net.Addr) bool {
+	if tru.batch == nil {
+		return false
+	}
+	_, ok := addr.(*net.UDPAddr)
+	return ok
+}
+
+// writeBatch write batch of packets
+func (tru *Tru) writeBatch(msgs []ipv4.Message) {
+	for len(msgs) > 0 {
+		n, err := tru.batch.WriteBatch(msgs, 0)
+		if err != nil || n == 0 {
+			// Write first packet without batch and continue
+			tru.conn.WriteTo(msgs[0].Buffers[0], msgs[0].Addr)
+			n = 1
+		}
+		msgs = msgs[n:]
+	}
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package tru
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// newBatchConn create batch udp packets reader and writer
+func newBatchConn(conn net.PacketConn) (bc batchConn) {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	if addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	raw, err := udp.SyscallConn()
+	if err != nil {
+		return
+	}
+	return &batchConn6{ipv6.NewPacketConn(conn), raw}
+}
+
+// batchConn6 is ipv6 (dual stack) socket batch reader and writer. Batch writer
+// of golang.org/x/net marshals ipv4 addresses to AF_INET socket address which
+// ipv6 socket does not accept, so batchConn6 writes packets by sendmmsg with
+// ipv4-mapped ipv6 socket addresses
+type batchConn6 struct {
+	*ipv6.PacketConn
+	raw syscall.RawConn
+}
+
+// mmsghdr is linux sendmmsg message header
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// WriteBatch write batch of packets, it returns number of packets written
+func (c *batchConn6) WriteBatch(ms []ipv4.Message, flags int) (n int, err error) {
+	if len(ms) == 0 {
+		return
+	}
+
+	// Make messages headers with ipv6 socket addresses
+	hs := make([]mmsghdr, len(ms))
+	names := make([]unix.RawSockaddrInet6, len(ms))
+	var iovs [][]unix.Iovec
+	for i := range ms {
+		addr, ok := ms[i].Addr.(*net.UDPAddr)
+		if !ok || addr.IP.To16() == nil {
+			err = errors.New("wrong batch message address")
+			return
+		}
+		names[i].Family = unix.AF_INET6
+		port := (*[2]byte)(unsafe.Pointer(&names[i].Port))
+		port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(names[i].Addr[:], addr.IP.To16())
+		if addr.Zone != "" {
+			if ifi, e := net.InterfaceByName(addr.Zone); e == nil {
+				names[i].Scope_id = uint32(ifi.Index)
+			}
+		}
+		hs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		hs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+
+		iov := make([]unix.Iovec, 0, len(ms[i].Buffers))
+		for _, b := range ms[i].Buffers {
+			if len(b) == 0 {
+				continue
+			}
+			v := unix.Iovec{Base: &b[0]}
+			v.SetLen(len(b))
+			iov = append(iov, v)
+		}
+		if len(iov) > 0 {
+			hs[i].hdr.Iov = &iov[0]
+			hs[i].hdr.SetIovlen(len(iov))
+		}
+		iovs = append(iovs, iov)
+	}
+
+	// Write messages by sendmmsg when socket is ready
+	var errno syscall.Errno
+	err = c.raw.Write(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd,
+			uintptr(unsafe.Pointer(&hs[0])), uintptr(len(hs)), uintptr(flags),
+			0, 0)
+		if e == unix.EAGAIN {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	runtime.KeepAlive(names)
+	runtime.KeepAlive(iovs)
+	if err == nil && errno != 0 {
+		n, err = 0, os.NewSyscallError("sendmmsg", errno)
+	}
+	for i := range ms[:n] {
+		ms[i].N = int(hs[i].len)
+	}
+	return
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package tru
+
+import "net"
+
+// newBatchConn return nil, batch udp io does not supported
+func newBatchConn(conn net.PacketConn) (bc batchConn) { return }
@@ -0,0 +1,218 @@
+package tru
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+	"golang.org/x/net/ipv4"
+)
+
+// BenchmarkWrite compares writing udp packets one by one with batch write
+// from dual stack socket to ipv4 and ipv6 peers
+func BenchmarkWrite(b *testing.B) {
+	b.Run("ipv4", func(b *testing.B) { benchmarkWrite(b, "127.0.0.1:0") })
+	b.Run("ipv6", func(b *testing.B) { benchmarkWrite(b, "[::1]:0") })
+}
+
+func benchmarkWrite(b *testing.B, address string) {
+
+	// Sink socket reads and drops packets
+	sink, err := net.ListenPacket("udp", address)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	go func() {
+		buf := make([]byte, readBufferLen)
+		for {
+			if _, _, err := sink.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	tru, err := New(0, teolog.New())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tru.Close()
+	if tru.batch == nil {
+		b.Skip("batch io is not supported")
+	}
+
+	data := make([]byte, 1200)
+	addr := sink.LocalAddr()
+
+	b.Run("loop", func(b *testing.B) {
+		start := time.Now()
+		for i := 0; i < b.N; i++ {
+			tru.conn.WriteTo(data, addr)
+		}
+		b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		msgs := make([]ipv4.Message, batchSize)
+		for i := range msgs {
+			msgs[i] = ipv4.Message{Buffers: [][]byte{data}, Addr: addr}
+		}
+		start := time.Now()
+		for i := 0; i < b.N; i += batchSize {
+			n := batchSize
+			if b.N-i < n {
+				n = b.N - i
+			}
+			tru.writeBatch(msgs[:n])
+		}
+		b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+	})
+}
+
+// BenchmarkChannelSend compares tru channel throughput with and without batch
+// udp io over ipv4 and ipv6 on dual stack sockets
+func BenchmarkChannelSend(b *testing.B) {
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		for _, mode := range []struct {
+			name  string
+			batch BatchIO
+		}{{"loop", false}, {"batch", true}} {
+			name := "ipv4/" + mode.name
+			if host == "::1" {
+				name = "ipv6/" + mode.name
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkChannelSend(b, host, mode.batch)
+			})
+		}
+	}
+}
+
+func benchmarkChannelSend(b *testing.B, host string, batch BatchIO) {
+	log := teolog.New()
+
+	received := make(chan interface{}, 1)
+	var recvPackets int
+	reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+		if err != nil {
+			return
+		}
+		recvPackets++
+		if recvPackets == b.N {
+			received <- nil
+		}
+		return
+	}
+
+	tru1, err := New(0, reader, batch, log)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tru1.Close()
+
+	tru2, err := New(0, batch, log)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tru2.Close()
+
+	port := strconv.Itoa(tru1.LocalAddr().(*net.UDPAddr).Port)
+	ch, err := tru2.Connect(net.JoinHostPort(host, port))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	data := make([]byte, 1200)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := ch.WriteTo(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-received
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+}
+
+func TestBatchable(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	v4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	v6 := &net.UDPAddr{IP: net.IPv6loopback, Port: 1000}
+
+	// Dual stack socket writes to ipv4 and ipv6 peers by batch
+	tru, err := New(0, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tru.Close()
+	if tru.batch == nil {
+		t.Skip("batch io is not supported")
+	}
+	if !tru.batchable(v4) || !tru.batchable(v6) {
+		t.Error("wrong batchable addresses of dual stack socket")
+	}
+
+	// Ipv4 socket writes to ipv4 peers by batch
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tru4, err := New(0, conn, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tru4.Close()
+	if !tru4.batchable(v4) {
+		t.Error("ipv4 address does not batchable by ipv4 socket")
+	}
+}
+
+func TestBatchWriteDualStack(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	tru, err := New(0, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tru.Close()
+	if tru.batch == nil {
+		t.Skip("batch io is not supported")
+	}
+
+	// Dual stack socket writes batch to ipv4 and ipv6 peers
+	for _, network := range []string{"127.0.0.1:0", "[::1]:0"} {
+		sink, err := net.ListenPacket("udp", network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sink.Close()
+
+		msgs := make([]ipv4.Message, 4)
+		for i := range msgs {
+			msgs[i] = ipv4.Message{Buffers: [][]byte{[]byte("data")},
+				Addr: sink.LocalAddr()}
+		}
+		n, err := tru.batch.WriteBatch(msgs, 0)
+		if err != nil || n != len(msgs) {
+			t.Fatalf("can't write batch to %s, n: %d, err: %v",
+				sink.LocalAddr(), n, err)
+		}
+
+		buf := make([]byte, readBufferLen)
+		for i := range msgs {
+			sink.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := sink.ReadFrom(buf)
+			if err != nil || string(buf[:n]) != "data" {
+				t.Fatalf("packet %d not received by %s, err: %v", i,
+					sink.LocalAddr(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU BBR congestion control module
+
+package tru
+
+import (
+	"sync"
+	"time"
+)
+
+// CongestionPacer is optional CongestionController interface. Data packets of
+// channels with pacer congestion controller paced in tru sender process: each
+// packet sent not earlier than time returned by NextSendTime.
+type CongestionPacer interface {
+	// NextSendTime reserves send time for data packet with bytes length and
+	// return it
+	NextSendTime(bytes int) time.Time
+}
+
+// CongestionEstimator is optional CongestionController interface. It return
+// congestion controller path estimates shown in channels statistic.
+type CongestionEstimator interface {
+	// Bandwidth return estimated bottleneck bandwidth in bytes per second
+	Bandwidth() float64
+
+	// MinRTT return estimated minimal trip time
+	MinRTT() time.Duration
+}
+
+// BBR congestion controller constants
+const (
+	bbrHighGain       = 2.885                  // Startup gain 2/ln(2)
+	bbrCwndGain       = 2.0                    // ProbeBW cwnd gain
+	bbrBwFilterLen    = 10                     // Bandwidth filter length, rounds
+	bbrFullBwGrowth   = 1.25                   // Startup bandwidth growth
+	bbrFullBwRounds   = 3                      // Startup rounds without growth
+	bbrMinRTTExpired  = 10 * time.Second       // Min RTT expired (ProbeRTT) time
+	bbrProbeRTTTime   = 200 * time.Millisecond // ProbeRTT state duration
+	bbrMinWindow      = 4 * renoMSS            // Min congestion window
+	bbrInitialWindow  = renoInitialWindow      // Congestion window without estimates
+	bbrMinRoundPeriod = 5 * time.Millisecond   // Min bandwidth sample period
+)
+
+// bbrPacingGains is ProbeBW state pacing gains cycle
+var bbrPacingGains = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// bbrState is BBR congestion controller state
+type bbrState int
+
+const (
+	bbrStartup bbrState = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+// bbrCongestion is model based BBR style congestion controller
+type bbrCongestion struct {
+	state      bbrState
+	pacingGain float64 // Current pacing gain
+	cwndGain   float64 // Current congestion window gain
+
+	bwSamples [bbrBwFilterLen]float64 // Rounds max delivery rate, bytes/sec
+	bwIndex   int                     // Current round index in bwSamples
+	btlBw     float64                 // Bottleneck bandwidth, bytes/sec
+
+	minRTT      time.Duration // Minimal trip time
+	minRTTStamp time.Time     // Minimal trip time set time
+
+	sent           int       // Number of bytes sent
+	delivered      int       // Number of bytes delivered
+	roundSent      int       // Number of bytes sent at round start
+	roundDelivered int       // Number of bytes delivered at round start
+	roundStart     time.Time // Current round start time
+	roundBusy      bool      // Packets wait congestion window during round
+
+	fullBw      float64 // Bandwidth at last startup growth
+	fullBwCount int     // Startup rounds without bandwidth growth
+
+	cycleIndex int       // ProbeBW pacing gains cycle index
+	cycleStamp time.Time // ProbeBW current gain start time
+	probeRTT   time.Time // ProbeRTT state end time
+
+	nextSend time.Time // Pacer next send time
+
+	sync.Mutex
+}
+
+// NewBBRCongestion create model based BBR style congestion controller. It
+// estimates bottleneck bandwidth from acks arrival rate and minimal trip time
+// from trip time samples, paces packets with estimated bandwidth and limits
+// inflight bytes to bandwidth-delay product. So it does not fill network
+// buffers and does not increase trip time.
+func NewBBRCongestion() CongestionController {
+	return &bbrCongestion{
+		state:      bbrStartup,
+		pacingGain: bbrHighGain,
+		cwndGain:   bbrHighGain,
+		roundStart: time.Now(),
+	}
+}
+
+// OnSent counts sent bytes
+func (c *bbrCongestion) OnSent(bytes int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.sent += bytes
+}
+
+// OnAck updates bandwidth and minimal trip time estimates and switch BBR
+// state
+func (c *bbrCongestion) OnAck(bytes int, rtt time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.delivered += bytes
+
+	// Update minimal trip time
+	if rtt > 0 && (c.minRTT == 0 || rtt <= c.minRTT ||
+		now.Sub(c.minRTTStamp) > bbrMinRTTExpired) {
+		if c.state != bbrProbeRTT && c.minRTT != 0 && rtt > c.minRTT {
+			c.enterProbeRTT(now)
+		}
+		c.minRTT = rtt
+		c.minRTTStamp = now
+	}
+
+	// Update bandwidth estimate when round (minimal trip time) finished. The
+	// delivery rate sample limited by send rate to skip acks compression, and
+	// skipped if it less than current estimate and application does not send
+	// enough data during the round
+	period := now.Sub(c.roundStart)
+	if period < c.minRTT || period < bbrMinRoundPeriod {
+		return
+	}
+	rate := float64(c.delivered-c.roundDelivered) / period.Seconds()
+	if sendRate := float64(c.sent-c.roundSent) / period.Seconds(); sendRate < rate {
+		rate = sendRate
+	}
+	appLimited := !c.roundBusy
+	c.roundStart = now
+	c.roundSent = c.sent
+	c.roundDelivered = c.delivered
+	c.roundBusy = false
+	if appLimited && rate < c.btlBw {
+		c.updateState(now)
+		return
+	}
+	c.bwIndex = (c.bwIndex + 1) % bbrBwFilterLen
+	c.bwSamples[c.bwIndex] = rate
+	c.btlBw = 0
+	for _, bw := range c.bwSamples {
+		if bw > c.btlBw {
+			c.btlBw = bw
+		}
+	}
+
+	c.updateState(now)
+}
+
+// OnLoss calls when data packet lost. BBR does not react to packet loss.
+func (c *bbrCongestion) OnLoss(bytes int) {}
+
+// CanSend return true if inflight bytes less than congestion window
+func (c *bbrCongestion) CanSend(inflight int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.state == bbrDrain && inflight <= c.targetWindow() {
+		c.enterProbeBW(time.Now())
+	}
+	can := inflight == 0 || inflight < c.cwnd()
+	if !can {
+		c.roundBusy = true
+	}
+	return can
+}
+
+// PacingDelay return zero, BBR controller paces packets in sender process
+func (c *bbrCongestion) PacingDelay() time.Duration { return 0 }
+
+// NextSendTime reserves send time for data packet with bytes length
+func (c *bbrCongestion) NextSendTime(bytes int) (t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	t = time.Now()
+	if c.nextSend.After(t) {
+		t = c.nextSend
+	}
+	if rate := c.pacingGain * c.btlBw; rate > 0 {
+		c.nextSend = t.Add(time.Duration(float64(bytes) / rate * float64(time.Second)))
+	}
+	return
+}
+
+// Bandwidth return estimated bottleneck bandwidth in bytes per second
+func (c *bbrCongestion) Bandwidth() float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.btlBw
+}
+
+// MinRTT return estimated minimal trip time
+func (c *bbrCongestion) MinRTT() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.minRTT
+}
+
+// updateState switch BBR state at the end of round, should be called under
+// lock
+func (c *bbrCongestion) updateState(now time.Time) {
+	switch c.state {
+
+	// Exit startup when bandwidth does not grow during some rounds
+	case bbrStartup:
+		if c.btlBw >= c.fullBw*bbrFullBwGrowth {
+			c.fullBw = c.btlBw
+			c.fullBwCount = 0
+			return
+		}
+		c.fullBwCount++
+		if c.fullBwCount >= bbrFullBwRounds {
+			c.state = bbrDrain
+			c.pacingGain = 1 / bbrHighGain
+			c.cwndGain = bbrHighGain
+		}
+
+	// Drain state finished in CanSend when inflight less than target window
+	case bbrDrain:
+
+	// Cycle pacing gains every minimal trip time
+	case bbrProbeBW:
+		if now.Sub(c.cycleStamp) > c.minRTT {
+			c.cycleIndex = (c.cycleIndex + 1) % len(bbrPacingGains)
+			c.cycleStamp = now
+			c.pacingGain = bbrPacingGains[c.cycleIndex]
+		}
+
+	// Return to probe bandwidth after ProbeRTT time
+	case bbrProbeRTT:
+		if now.After(c.probeRTT) {
+			c.enterProbeBW(now)
+		}
+	}
+}
+
+// enterProbeBW switch to ProbeBW state, should be called under lock
+func (c *bbrCongestion) enterProbeBW(now time.Time) {
+	c.state = bbrProbeBW
+	c.cwndGain = bbrCwndGain
+	c.cycleIndex = 0
+	c.cycleStamp = now
+	c.pacingGain = bbrPacingGains[c.cycleIndex]
+}
+
+// enterProbeRTT switch to ProbeRTT state, should be called under lock
+func (c *bbrCongestion) enterProbeRTT(now time.Time) {
+	if c.state == bbrStartup {
+		return
+	}
+	c.state = bbrProbeRTT
+	c.pacingGain = 1
+	c.probeRTT = now.Add(bbrProbeRTTTime)
+}
+
+// bdp return bandwidth-delay product, should be called under lock
+func (c *bbrCongestion) bdp() int {
+	return int(c.btlBw * c.minRTT.Seconds())
+}
+
+// cwnd return congestion window, should be called under lock
+func (c *bbrCongestion) cwnd() (cwnd int) {
+	if c.btlBw == 0 || c.minRTT == 0 {
+		return bbrInitialWindow
+	}
+	if c.state == bbrProbeRTT {
+		return bbrMinWindow
+	}
+	cwnd = int(c.cwndGain * float64(c.bdp()))
+	if cwnd < bbrInitialWindow {
+		cwnd = bbrInitialWindow
+	}
+	return
+}
+
+// targetWindow return inflight bytes target of Drain state, should be called
+// under lock
+func (c *bbrCongestion) targetWindow() int {
+	if bdp := c.bdp(); bdp > bbrInitialWindow {
+		return bdp
+	}
+	return bbrInitialWindow
+}
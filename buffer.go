@@ -0,0 +1,47 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Buffers pool module
+
+package tru
+
+import "sync"
+
+// bufferSizes is pooled buffers size classes. Received packets data copied to
+// smallest buffer it fits, so short packets waiting in receive queue and in
+// reader does not hold large read buffers.
+var bufferSizes = [...]int{2 * 1024, 16 * 1024, readBufferLen}
+
+// bufferPools is pools of buffers by size classes
+var bufferPools [len(bufferSizes)]sync.Pool
+
+// getBuffer get buffer with length of size class which fits n bytes from pool
+// or create new buffer
+func getBuffer(n int) *[]byte {
+	for i, size := range bufferSizes {
+		if n > size {
+			continue
+		}
+		if bufp, ok := bufferPools[i].Get().(*[]byte); ok {
+			return bufp
+		}
+		buf := make([]byte, size)
+		return &buf
+	}
+	buf := make([]byte, n)
+	return &buf
+}
+
+// putBuffer return buffer to pool, buffers with capacity of no one size class
+// left to garbage collector
+func putBuffer(bufp *[]byte) {
+	c := cap(*bufp)
+	for i, size := range bufferSizes {
+		if c == size {
+			*bufp = (*bufp)[:size]
+			bufferPools[i].Put(bufp)
+			return
+		}
+	}
+}
@@ -7,44 +7,71 @@
 package tru
 
 import (
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"reflect"
+	"sync/atomic"
 	"time"
 )
 
 type Channel struct {
-	addr       net.Addr      // Peer address
-	serverMode bool          // Server mode if true
-	id         uint32        // Next send ID
-	expectedID uint32        // Next expected ID
-	reader     ReaderFunc    // Channels reader
-	stat       statistic     // Statictic struct and receiver
-	sendQueue  sendQueue     // Send queue
-	recvQueue  receiveQueue  // Receive queue
-	tru        *Tru          // Pointer to tru
-	combine    combinePacket // Combine lage packet
-	maxDataLen int           // Max data len in created packets
-	*crypt                   // Crypt module
+	addr           atomic.Value      // Peer address, changed by connection migration
+	serverMode     bool              // Server mode if true
+	id             uint32            // Next send ID
+	expectedID     uint32            // Next expected ID
+	sendEpoch      uint32            // Send ID epoch
+	recvEpoch      uint32            // Expected ID epoch
+	seq            seqSpace          // Packet ID sequence space
+	reader         ReaderFunc        // Channels reader
+	stat           statistic         // Statictic struct and receiver
+	sendQueue      sendQueue         // Send queue
+	recvQueue      receiveQueue      // Receive queue
+	tru            *Tru              // Pointer to tru
+	combine        combinePacket     // Combine lage packet
+	maxDataLen     int               // Max data len in created packets
+	ack            acker             // Delayed acknowledgement
+	congestionCtrl atomic.Value      // Congestion controller
+	readerBacklog  atomic.Int32      // Number of packets wait in reader
+	readerQueue    channelReader     // Channels reader queue
+	header         channelHeader     // Packet header negotiated in handshake
+	peerKey        ed25519.PublicKey // Peer identity key, nil in legacy handshake
+	hello          []byte            // Hello data received from peer in handshake
+	resumed        bool              // Session resumed by session ticket
+	connectPending atomic.Bool       // Connected by first authenticated data packet
+	path           pathValidation    // New peer address validation
+	pacer          pacer             // Paced data packets queue
+	*crypt                           // Crypt module
 }
 
 // const MaxUint16 = ^uint16(0)
 
 var ErrChannelDestroyed = errors.New("channel destroyed")
 var ErrChannelAlreadyDestroyed = errors.New("channel already destroyed")
+var ErrWouldBlock = errors.New("channel send queue is full")
+
+// NewChannel create new tru channel by address and packet header parameters
+// negotiated in handshake
+func (tru *Tru) newChannel(addr net.Addr, header channelHeader,
+	serverMode ...bool) (ch *Channel, err error) {
 
-// NewChannel create new tru channel by address
-func (tru *Tru) newChannel(addr net.Addr, serverMode ...bool) (ch *Channel, err error) {
 	tru.mu.Lock()
 	defer tru.mu.Unlock()
 
+	if _, ok := tru.connIDs[header.connID]; ok && header.connID != 0 {
+		err = errors.New("connection id already used")
+		return
+	}
+
 	msg := fmt.Sprint("new channel ", addr.String())
 	log.Connect.Println(msg)
 	tru.statMsgs.add(msg)
 
-	ch = &Channel{addr: addr, tru: tru, maxDataLen: tru.maxDataLen}
+	ch = &Channel{tru: tru, maxDataLen: tru.maxDataLen, header: header}
+	ch.seq = newSeqSpace(header.version)
+	ch.addr.Store(addr)
 	if len(serverMode) > 0 {
 		ch.serverMode = serverMode[0]
 	}
@@ -52,36 +79,46 @@ func (tru *Tru) newChannel(addr net.Addr, serverMode ...bool) (ch *Channel, err
 	if err != nil {
 		return
 	}
-	ch.sendQueue.init(ch)
+	ch.sendQueue.init(tru.sendQueueLimit, ch.seq)
 	ch.recvQueue.init(ch)
+	ch.readerInit()
 	ch.stat.init(
 		// Inactive
 		func() {
-			ch.destroy(fmt.Sprint("channel inactive, destroy ", ch.addr.String()))
+			ch.destroy(fmt.Sprint("channel inactive, destroy ", ch.Addr().String()))
 		},
 		// Keepalive
 		func() {
 			if ch.serverMode {
 				return
 			}
-			log.Debugvvv.Println("ping", ch.addr.String())
+			log.Debugvvv.Println("ping", ch.Addr().String())
 			ch.writeToPing()
 		},
 	)
-	// Set default send delay in client mode
-	if !ch.serverMode {
-		ch.stat.sendDelay = tru.sendDelay
+	// Create congestion controller and set default legacy controller send
+	// delay
+	cc := tru.congestion()
+	if l, ok := cc.(*legacyCongestion); ok {
+		l.setDelay(tru.sendDelay)
 	}
+	ch.SetCongestionController(cc)
 	tru.channels[addr.String()] = ch
-
-	// Channel connect to server callback
-	if ch.serverMode && ch.tru.connectcb != nil {
-		ch.tru.connectcb(ch, nil)
+	if header.connID != 0 {
+		tru.connIDs[header.connID] = ch
 	}
 
 	return
 }
 
+// connected execute connect to this server callback when server mode channel
+// connected
+func (tru *Tru) connected(ch *Channel) {
+	if tru.connectcb != nil {
+		tru.connectcb(ch, nil)
+	}
+}
+
 // getChannel get tru channel by address
 func (tru *Tru) getChannel(addr string) (ch *Channel, ok bool) {
 	tru.mu.RLock()
@@ -91,6 +128,15 @@ func (tru *Tru) getChannel(addr string) (ch *Channel, ok bool) {
 	return
 }
 
+// getChannelByConnID get tru channel by connection id
+func (tru *Tru) getChannelByConnID(connID uint32) (ch *Channel, ok bool) {
+	tru.mu.RLock()
+	defer tru.mu.RUnlock()
+
+	ch, ok = tru.connIDs[connID]
+	return
+}
+
 // getChannelRandom get tru channel random
 // func (tru *Tru) getChannelRandom() (ch *Channel) {
 // 	tru.mu.RLock()
@@ -117,13 +163,23 @@ func (tru *Tru) ForEachChannel(f func(ch *Channel)) {
 	}
 }
 
-// writeToPunch write puch packet
+// writeToPunch write puch packet. It returns ErrPunchRateLimit if punch rate
+// limit to address ip exceeded
 func (tru *Tru) WriteToPunch(data []byte, addri interface{}) (addr net.Addr, err error) {
+	addr, err = resolveAddr(addri)
+	if err != nil {
+		return
+	}
+	if addr != nil && !tru.punchSend.allow(addr) {
+		tru.limits.punchSend.Add(1)
+		err = ErrPunchRateLimit
+		return
+	}
 	data, err = tru.newPacket().SetStatus(statusPunch).SetData(data).MarshalBinary()
 	if err != nil {
 		return
 	}
-	return tru.WriteTo(data, addri)
+	return tru.WriteTo(data, addr)
 }
 
 // setReader sets channels reafer
@@ -145,18 +201,27 @@ func (ch *Channel) destroy(msg string) {
 		ch.tru.reader(ch, nil, ErrChannelDestroyed)
 	}
 
-	// Destroy sendQueue and statistic
-	ch.sendQueue.destroy()
+	// Destroy sendQueue, reader, ack timer and statistic
+	ch.tru.retransmit.cancel(ch.sendQueue.destroy()...)
+	ch.readerDestroy()
+	ch.ackDestroy()
+	ch.pacerDestroy()
 	ch.stat.destroy()
 
 	// Log messages
 	log.Connect.Println(msg)
 	ch.tru.statMsgs.add(msg)
 
-	// Delete channel from channels
+	// Delete channel from channels. Other channel may use channels address
+	// after connection migration
 	ch.tru.mu.Lock()
 	defer ch.tru.mu.Unlock()
-	delete(ch.tru.channels, ch.addr.String())
+	if key := ch.Addr().String(); ch.tru.channels[key] == ch {
+		delete(ch.tru.channels, key)
+	}
+	if ch.tru.connIDs[ch.header.connID] == ch {
+		delete(ch.tru.connIDs, ch.header.connID)
+	}
 }
 
 // Close tru channel
@@ -165,7 +230,7 @@ func (ch *Channel) Close() {
 		return
 	}
 	ch.writeToDisconnect()
-	ch.destroy(fmt.Sprint("channel close, destroy ", ch.addr.String()))
+	ch.destroy(fmt.Sprint("channel close, destroy ", ch.Addr().String()))
 }
 
 // Destroyed return true if channel is already destroyed
@@ -175,7 +240,7 @@ func (ch *Channel) Destroyed() bool {
 
 // Addr return tru channels address
 func (ch *Channel) Addr() net.Addr {
-	return ch.addr
+	return ch.addr.Load().(net.Addr)
 }
 
 // String return channels address in string
@@ -193,7 +258,7 @@ func (ch *Channel) Port() int {
 	return ch.Addr().(*net.UDPAddr).Port
 }
 
-// Addr return tru channels address
+// Triptime return tru channels smoothed trip time
 func (ch *Channel) Triptime() time.Duration {
 	return ch.getTripTime()
 }
@@ -203,19 +268,64 @@ func (ch *Channel) ServerMode() bool {
 	return ch.serverMode
 }
 
+// Version return protocol version negotiated with peer
+func (ch *Channel) Version() int {
+	return int(ch.header.version)
+}
+
 // WriteTo writes packet with data to tru channel. Second parameter delivery is
 // callback function of PacketDeliveryFunc func, it calls when packet deliverid
 // to remout peer. The third parameter is the delivery callback timeout. The
 // PacketDeliveryFunc callback parameter is pac - pointer to send packet, and
-// err - timeout error or success if nil.
+// err - timeout error or success if nil. WriteTo blocks while channels send
+// queue is full or peer receive window closed.
 func (ch *Channel) WriteTo(data []byte, delivery ...interface{}) (id int, err error) {
+	return ch.WriteToContext(context.Background(), data, delivery...)
+}
+
+// WriteToContext writes packet with data to tru channel like WriteTo. It
+// waits while channels send queue is full or peer receive window closed and
+// returns ctx.Err() if context done before data written.
+func (ch *Channel) WriteToContext(ctx context.Context, data []byte,
+	delivery ...interface{}) (id int, err error) {
+
+	err = ch.sendQueue.wait(ctx, ch.splitNum(data), len(data))
+	if err != nil {
+		return
+	}
+	return ch.writeToData(data, delivery)
+}
+
+// TryWriteTo writes packet with data to tru channel like WriteTo, but does not
+// wait and returns ErrWouldBlock if channels send queue is full, peer receive
+// window closed or tru write channel is full.
+func (ch *Channel) TryWriteTo(data []byte, delivery ...interface{}) (id int, err error) {
+	if !ch.sendQueue.fits(ch.splitNum(data), len(data)) || ch.tru.senderFull() {
+		err = ErrWouldBlock
+		return
+	}
+	return ch.writeToData(data, delivery, true)
+}
+
+// writeToData split data to packets and writes it to channel. Packets sent to
+// write channel without waiting if nonblock parameter is true
+func (ch *Channel) writeToData(data []byte, delivery []interface{},
+	nonblock ...bool) (id int, err error) {
+
 	return ch.splitPacket(data, func(data []byte, split int) (int, error) {
-		return ch.writeTo(data, statusData|split, delivery)
+		id, err := ch.writeTo(data, statusData|split, delivery)
+		if err != nil {
+			return id, err
+		}
+		ch.sendQueue.flush(ch, nonblock...)
+		return id, nil
 	})
 }
 
 // writeTo writes a packet with status and data to channel
-func (ch *Channel) writeTo(data []byte, stat int, delivery []interface{}, ids ...int) (id int, err error) {
+func (ch *Channel) writeTo(data []byte, stat int, delivery []interface{},
+	ids ...int) (id int, err error) {
+
 	if ch.stat.isDestroyed() {
 		err = ErrChannelDestroyed
 		return
@@ -240,46 +350,45 @@ func (ch *Channel) writeTo(data []byte, stat int, delivery []interface{}, ids ..
 
 	status := stat &^ statusSplit
 
-	// Calculate and execute delay for client mode data packets
+	// Execute congestion controller pacing delay
 	ch.writeToDelay(status)
 
 	// Set packet id and encript data
 	if len(ids) > 0 {
 		id = ids[0]
 	}
+	var epoch uint32
 	if status == statusData {
-		id = ch.newID()
-		data, err = ch.encryptPacketData(id, data)
+		id, epoch = ch.newID()
+	}
+
+	// Create packet
+	pac := ch.newPacket().SetID(id).SetStatus(stat)
+	if status == statusData {
+		data, err = ch.encryptPacket(pac, epoch, data)
 		if err != nil {
 			return
 		}
 	}
+	pac.SetData(data)
 
-	// Create packet
-	pac := ch.tru.newPacket().SetID(id).SetStatus(stat).SetData(data)
-
-	// Add data packet to send queue and Set packet retransmit time
+	// Add data packet to send queue, it will be sent by send queue flush when
+	// congestion controller allows
 	if status == statusData {
-		ch.setRetransmitTime(pac)
-		ch.sendQueue.add(pac)
 		if stat == statusData {
 			pac.SetDeliveryTimeout(deliveryTimeout)
 			pac.SetDelivery(deliveryFunc)
 			ch.stat.setSend()
 		}
 		ch.stat.setLastSend(time.Now())
+		ch.sendQueue.push(pac)
+		return
 	}
 
 	// Send disconnect packet immediately
 	if status == statusDisconnect {
 		data, _ := pac.MarshalBinary()
-		_, err = ch.tru.WriteTo(data, ch.addr)
-		return
-	}
-
-	// Drop packet for testing if drop flag is set. Drops every value of
-	// drop packet. If drop contain 5 than every 5th packet will be dropped
-	if *drop > 0 && status == statusData && !ch.serverMode && rand.Intn(*drop) == 0 {
+		_, err = ch.tru.WriteTo(data, ch.Addr())
 		return
 	}
 
@@ -289,45 +398,16 @@ func (ch *Channel) writeTo(data []byte, stat int, delivery []interface{}, ids ..
 	return
 }
 
-// writeToDelay calculate and execute delay for client mode data packets
+// writeToDelay execute congestion controller pacing delay for data packets
 func (ch *Channel) writeToDelay(status int) {
 
-	// Use client mode data packages only
-	if !(!ch.serverMode && status == statusData) {
+	// Use data packages only
+	if status != statusData {
 		return
 	}
 
-	// Sleep up to 300 microseconds while fist packet has retransmit attempt
-	var retransmitDelayCount = 0
-	const minSendDelay = 15
-	for rta := ch.sendQueue.getRetransmitAttempts(); rta > 0 && retransmitDelayCount < 20; retransmitDelayCount++ {
-		time.Sleep(minSendDelay * time.Microsecond)
-		rta = ch.sendQueue.getRetransmitAttempts()
-	}
-
-	// Get current delay
-	var chSendDelay = ch.stat.getSendDelay()
-	delay := time.Duration(chSendDelay) * time.Microsecond
-	if time.Since(ch.stat.lastDelayCheck) > 30*time.Millisecond {
-
-		// Claculate new delay
-		if retransmitDelayCount == 0 {
-			switch {
-			case ch.stat.sendDelay > 100:
-				chSendDelay -= 10
-			case ch.stat.sendDelay > minSendDelay:
-				chSendDelay -= 1
-			}
-		} else {
-			chSendDelay += 10
-		}
-
-		// Set new delay
-		ch.stat.lastDelayCheck = time.Now()
-		ch.stat.setSendDelay(chSendDelay)
-	}
-
-	// Execute current delay
+	// Execute pacing delay
+	delay := ch.congestion().PacingDelay()
 	if since := time.Since(ch.stat.getLastSend()); since < delay {
 		time.Sleep(delay - since)
 	}
@@ -345,12 +425,6 @@ func (ch *Channel) writeToPong() (err error) {
 	return
 }
 
-// writeToAck writes ack packet to channel
-func (ch *Channel) writeToAck(pac *Packet) (err error) {
-	_, err = ch.writeTo(nil, statusAck, nil, pac.ID())
-	return
-}
-
 // writeToDisconnect write disconnect packet
 func (ch *Channel) writeToDisconnect() (err error) {
 	_, err = ch.writeTo(nil, statusDisconnect, nil)
@@ -362,16 +436,27 @@ func (ch *Channel) writeToSender(pac *Packet) {
 	ch.tru.senderCh <- senderChData{ch, pac}
 }
 
-// newID create new channels packet id
-func (ch *Channel) newID() (id int) {
+// tryWriteToSender write packet to sender process channel if it is not full,
+// it returns false if packet was not written
+func (ch *Channel) tryWriteToSender(pac *Packet) bool {
+	select {
+	case ch.tru.senderCh <- senderChData{ch, pac}:
+		return true
+	default:
+		return false
+	}
+}
+
+// newID create new channels packet id, it returns id and its epoch
+func (ch *Channel) newID() (id int, epoch uint32) {
 	ch.tru.mu.Lock()
 	defer ch.tru.mu.Unlock()
 
-	id = int(ch.id)
+	id, epoch = int(ch.id), ch.sendEpoch
 
-	ch.id++
-	if ch.id >= packetIDLimit {
-		ch.id = 0
+	ch.id = ch.seq.next(ch.id)
+	if ch.id == 0 {
+		ch.sendEpoch = ch.nextEpoch(ch.sendEpoch)
 	}
 
 	return
@@ -382,9 +467,9 @@ func (ch *Channel) newExpectedID() (id int) {
 	ch.tru.mu.Lock()
 	defer ch.tru.mu.Unlock()
 
-	ch.expectedID++
-	if ch.expectedID >= packetIDLimit {
-		ch.expectedID = 0
+	ch.expectedID = ch.seq.next(ch.expectedID)
+	if ch.expectedID == 0 {
+		ch.recvEpoch = ch.nextEpoch(ch.recvEpoch)
 	}
 
 	id = int(ch.expectedID)
@@ -392,29 +477,42 @@ func (ch *Channel) newExpectedID() (id int) {
 	return
 }
 
-// setTripTime calculate return and set trip time to statistic
-func (ch *Channel) setTripTime(id int) (tt time.Duration, err error) {
+// getExpectedID return channels packet expected id
+func (ch *Channel) getExpectedID() uint32 {
+	ch.tru.mu.RLock()
+	defer ch.tru.mu.RUnlock()
+
+	return ch.expectedID
+}
+
+// setTripTime calculate return and set trip time to statistic. The ackDelay
+// is time between packet received by peer and ack sent, it subtracted from
+// trip time. Retransmitted packets does not give trip time sample (Karn's
+// algorithm), zero tt returned for them
+func (ch *Channel) setTripTime(id int, ackDelay time.Duration) (tt time.Duration, err error) {
 	_, pac, ok := ch.sendQueue.get(id)
 	if !ok {
 		err = errors.New("packet not found")
 		return
 	}
+	if pac.getRetransmitAttempts() > 0 {
+		return
+	}
 
 	ch.stat.Lock()
 	defer ch.stat.Unlock()
 
-	tt = time.Since(pac.time)
-	ch.stat.tripTime = tt
-	if ch.stat.tripTimeMidle != 0 {
-		ch.stat.tripTimeMidle = (ch.stat.tripTimeMidle*9 + tt) / 10
-	} else {
-		ch.stat.tripTimeMidle = tt
+	tt = time.Since(pac.getTime())
+	if ackDelay < tt {
+		tt -= ackDelay
 	}
+	ch.stat.tripTime = tt
+	ch.stat.setRTT(tt)
 
 	return
 }
 
-// getTripTime return current channel trip time
+// getTripTime return current channel smoothed trip time
 func (ch *Channel) getTripTime() time.Duration {
 	ch.stat.RLock()
 	defer ch.stat.RUnlock()
@@ -422,24 +520,34 @@ func (ch *Channel) getTripTime() time.Duration {
 	return ch.stat.tripTimeMidle
 }
 
-// setRetransmitTime set retransmit time to packet
+// setRetransmitTime set retransmit time to packet and schedule packet
+// retransmit. The channels retransmission timeout doubled for each packet
+// retransmit attempt
 func (ch *Channel) setRetransmitTime(pac *Packet) (rt time.Time, err error) {
-	rtt := minRTT
-	if tt := ch.getTripTime(); tt == 0 {
-		rtt = startRTT
-	} else {
-		rtt += tt
-	}
-
-	if ra := pac.getRetransmitAttempts(); ra > 0 {
-		rtt *= time.Duration(ra + 1)
-	}
+	rto := backoffRTO(ch.stat.getRTO(), pac.getRetransmitAttempts())
+	pac.setRetransmitTime(rto)
+	ch.tru.retransmit.schedule(ch, pac)
+	return
+}
 
-	if rtt > maxRTT {
-		rtt = maxRTT
-	}
+// resend packet from send queue by retransmit timeout: increment retransmit
+// attempts, set new retransmit time and send packet to write channel
+func (ch *Channel) resend(pac *Packet) {
+	ch.retransmitPacket(pac)
+	ch.stat.setRetransmit()
+}
 
-	pac.setRetransmitTime(rtt)
+// fastResend packet from send queue when acks to next packets received
+func (ch *Channel) fastResend(pac *Packet) {
+	ch.retransmitPacket(pac)
+	ch.stat.setFastRetransmit()
+}
 
-	return
+// retransmitPacket increment retransmit attempts, set new retransmit time and
+// send packet to write channel
+func (ch *Channel) retransmitPacket(pac *Packet) {
+	pac.setRetransmitAttempts(pac.getRetransmitAttempts() + 1)
+	ch.setRetransmitTime(pac)
+	ch.congestion().OnLoss(len(pac.data))
+	ch.writeToSender(pac)
 }
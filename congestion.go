@@ -0,0 +1,230 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Congestion control module
+
+package tru
+
+import (
+	"sync"
+	"time"
+)
+
+// CongestionController is channels congestion control algorithm. All methods
+// may be called from different goroutines, so implementation must be safe
+// for concurrent use.
+type CongestionController interface {
+	// OnSent calls when new data packet with bytes length sent
+	OnSent(bytes int)
+
+	// OnAck calls when data packet with bytes length acknowledged, rtt is
+	// trip time sample or 0 if there is not sample for this packet
+	OnAck(bytes int, rtt time.Duration)
+
+	// OnLoss calls when data packet with bytes length lost and retransmitted
+	OnLoss(bytes int)
+
+	// CanSend return true if next data packet may be sent when inflight bytes
+	// sent and not acknowledged yet
+	CanSend(inflight int) bool
+
+	// PacingDelay return delay between sending data packets
+	PacingDelay() time.Duration
+}
+
+// CongestionControl is New() parameter type. It is function which creates
+// congestion controller for each new channel, f.e. NewRenoCongestion,
+// NewBBRCongestion or LegacyCongestion
+type CongestionControl func() CongestionController
+
+// congestionHolder holds channels congestion controller in atomic value
+type congestionHolder struct{ CongestionController }
+
+// congestion return channels congestion controller
+func (ch *Channel) congestion() CongestionController {
+	return ch.congestionCtrl.Load().(congestionHolder).CongestionController
+}
+
+// CongestionController return channels congestion controller
+func (ch *Channel) CongestionController() CongestionController {
+	return ch.congestion()
+}
+
+// SetCongestionController set channels congestion controller
+func (ch *Channel) SetCongestionController(cc CongestionController) {
+	ch.congestionCtrl.Store(congestionHolder{cc})
+}
+
+// NewReno congestion controller constants
+const (
+	renoMSS           = 1472         // Max segment size used in window calculation
+	renoInitialWindow = 10 * renoMSS // Initial congestion window
+	renoMinWindow     = 4 * renoMSS  // Minimal congestion window
+	renoMinRecovery   = minRTT       // Min recovery period after window reduced
+	renoMaxSsthresh   = 1 << 30      // Initial slow start threshold
+)
+
+// renoCongestion is window based NewReno style congestion controller
+type renoCongestion struct {
+	cwnd     int           // Congestion window in bytes
+	ssthresh int           // Slow start threshold
+	srtt     time.Duration // Smoothed trip time
+	recovery time.Time     // Recovery period start time
+	sync.Mutex
+}
+
+// NewRenoCongestion create window based NewReno style congestion controller.
+// The congestion window grows exponentially in slow start, than linearly
+// (one packet per trip time) and reduces twice on packet loss, but not
+// more often than once per trip time.
+func NewRenoCongestion() CongestionController {
+	return &renoCongestion{cwnd: renoInitialWindow, ssthresh: renoMaxSsthresh}
+}
+
+// OnSent calls when new data packet sent
+func (c *renoCongestion) OnSent(bytes int) {}
+
+// OnAck increases congestion window when data packet acknowledged
+func (c *renoCongestion) OnAck(bytes int, rtt time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if rtt > 0 {
+		if c.srtt == 0 {
+			c.srtt = rtt
+		} else {
+			c.srtt = (c.srtt*7 + rtt) / 8
+		}
+	}
+
+	// Does not increase window during recovery period
+	if time.Since(c.recovery) < c.recoveryPeriod() {
+		return
+	}
+
+	if c.cwnd < c.ssthresh {
+		c.cwnd += bytes // Slow start
+		return
+	}
+	inc := bytes * bytes / c.cwnd // Congestion avoidance
+	if inc == 0 {
+		inc = 1
+	}
+	c.cwnd += inc
+}
+
+// OnLoss reduces congestion window when data packet lost
+func (c *renoCongestion) OnLoss(bytes int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if time.Since(c.recovery) < c.recoveryPeriod() {
+		return
+	}
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < renoMinWindow {
+		c.ssthresh = renoMinWindow
+	}
+	c.cwnd = c.ssthresh
+	c.recovery = time.Now()
+}
+
+// CanSend return true if inflight bytes less than congestion window. One
+// packet may be sent any time when there is not inflight packets.
+func (c *renoCongestion) CanSend(inflight int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return inflight == 0 || inflight < c.cwnd
+}
+
+// PacingDelay return zero, NewReno controller does not pace packets
+func (c *renoCongestion) PacingDelay() time.Duration { return 0 }
+
+// recoveryPeriod return recovery period, should be called under lock
+func (c *renoCongestion) recoveryPeriod() time.Duration {
+	if c.srtt < renoMinRecovery {
+		return renoMinRecovery
+	}
+	return c.srtt
+}
+
+// Legacy congestion controller constants
+const (
+	legacyMinSendDelay   = 15                     // Min send delay in microseconds
+	legacyCheckInterval  = 30 * time.Millisecond  // Send delay check interval
+	legacyLossPauseDelay = 300 * time.Microsecond // Pause after packet lost
+)
+
+// legacyCongestion is send delay heuristic congestion controller
+type legacyCongestion struct {
+	delay     int       // Send delay in microseconds
+	lastCheck time.Time // Last delay check time
+	lastLoss  time.Time // Last packet loss time
+	loss      bool      // Packets lost after last delay check
+	sync.Mutex
+}
+
+// LegacyCongestion create legacy send delay heuristic congestion controller.
+// The send delay grows by 10 microseconds when packets lost and shrinks by 1
+// or 10 microseconds every 30 ms. Sending paused up to 300 microseconds after
+// packet lost. Start send delay sets by Tru.SetSendDelay.
+func LegacyCongestion() CongestionController {
+	return &legacyCongestion{delay: startSendDelay}
+}
+
+// OnSent recalculates send delay every 30 ms
+func (c *legacyCongestion) OnSent(bytes int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if time.Since(c.lastCheck) <= legacyCheckInterval {
+		return
+	}
+	switch {
+	case c.loss:
+		c.delay += 10
+	case c.delay > 100:
+		c.delay -= 10
+	case c.delay > legacyMinSendDelay:
+		c.delay -= 1
+	}
+	c.loss = false
+	c.lastCheck = time.Now()
+}
+
+// OnAck calls when data packet acknowledged
+func (c *legacyCongestion) OnAck(bytes int, rtt time.Duration) {}
+
+// OnLoss remembers packet loss
+func (c *legacyCongestion) OnLoss(bytes int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.loss = true
+	c.lastLoss = time.Now()
+}
+
+// CanSend always return true, legacy controller use pacing delay only
+func (c *legacyCongestion) CanSend(inflight int) bool { return true }
+
+// PacingDelay return current send delay, it increased after packet loss
+func (c *legacyCongestion) PacingDelay() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	delay := time.Duration(c.delay) * time.Microsecond
+	if since := time.Since(c.lastLoss); since < legacyLossPauseDelay {
+		delay += legacyLossPauseDelay - since
+	}
+	return delay
+}
+
+// setDelay set legacy congestion controller send delay
+func (c *legacyCongestion) setDelay(delay int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.delay = delay
+}
@@ -0,0 +1,97 @@
+package tru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenoCongestion(t *testing.T) {
+
+	cc := NewRenoCongestion().(*renoCongestion)
+	if !cc.CanSend(0) || cc.CanSend(renoInitialWindow) {
+		t.Errorf("wrong initial window: %d", cc.cwnd)
+	}
+
+	// Slow start
+	cc.OnAck(renoMSS, time.Millisecond)
+	if cc.cwnd != renoInitialWindow+renoMSS {
+		t.Errorf("wrong slow start window: %d", cc.cwnd)
+	}
+
+	// Packet loss reduces window twice once per recovery period
+	cwnd := cc.cwnd
+	cc.OnLoss(renoMSS)
+	cc.OnLoss(renoMSS)
+	if cc.cwnd != cwnd/2 || cc.ssthresh != cwnd/2 {
+		t.Errorf("wrong window after loss: %d", cc.cwnd)
+	}
+
+	// Window does not change during recovery period
+	cc.OnAck(renoMSS, time.Millisecond)
+	if cc.cwnd != cwnd/2 {
+		t.Errorf("window changed during recovery: %d", cc.cwnd)
+	}
+
+	// Congestion avoidance
+	cc.recovery = time.Time{}
+	cc.OnAck(renoMSS, time.Millisecond)
+	if inc := cc.cwnd - cwnd/2; inc <= 0 || inc >= renoMSS {
+		t.Errorf("wrong congestion avoidance increment: %d", inc)
+	}
+}
+
+func TestLegacyCongestion(t *testing.T) {
+
+	cc := LegacyCongestion().(*legacyCongestion)
+	if d := cc.PacingDelay(); d != startSendDelay*time.Microsecond {
+		t.Errorf("wrong start pacing delay: %v", d)
+	}
+
+	// Pause after loss and delay increment on next check
+	cc.OnLoss(0)
+	if d := cc.PacingDelay(); d <= startSendDelay*time.Microsecond {
+		t.Errorf("wrong pacing delay after loss: %v", d)
+	}
+	cc.OnSent(0)
+	if cc.delay != startSendDelay+10 {
+		t.Errorf("wrong delay after loss: %d", cc.delay)
+	}
+}
+
+func TestBBRCongestion(t *testing.T) {
+
+	cc := NewBBRCongestion().(*bbrCongestion)
+	if !cc.CanSend(0) || cc.CanSend(bbrInitialWindow) {
+		t.Errorf("wrong initial window: %d", cc.cwnd())
+	}
+
+	// Deliver 100 KB per 10 ms round during startup
+	rtt := 10 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		cc.roundStart = time.Now().Add(-rtt)
+		cc.OnSent(100 * 1024)
+		cc.OnAck(100*1024, rtt)
+	}
+	if bw := cc.Bandwidth(); bw < 5*1024*1024 || bw > 20*1024*1024 {
+		t.Errorf("wrong bandwidth estimate: %.0f", bw)
+	}
+	if cc.MinRTT() != rtt {
+		t.Errorf("wrong min rtt estimate: %v", cc.MinRTT())
+	}
+	if cc.state != bbrDrain {
+		t.Errorf("startup not finished, state: %d", cc.state)
+	}
+
+	// Drain finished when inflight less than target window
+	cc.CanSend(0)
+	if cc.state != bbrProbeBW {
+		t.Errorf("drain not finished, state: %d", cc.state)
+	}
+
+	// Pacer reserves send time by estimated bandwidth
+	t1 := cc.NextSendTime(renoMSS)
+	t2 := cc.NextSendTime(renoMSS)
+	if !t2.After(t1) {
+		t.Errorf("wrong pacer send time: %v, %v", t1, t2)
+	}
+}
@@ -8,9 +8,12 @@ package tru
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -24,23 +27,99 @@ const (
 	ServerConnectTimeout = waitConnectionTimeout
 )
 
+// Handshake packets retransmission backoff, it doubled after each
+// retransmission
+const (
+	connectBackoffMin = 250 * time.Millisecond
+	connectBackoffMax = 2 * time.Second
+)
+
+// ConnectTimeout parameter type sets time to wait connection established.
+// It sets default timeout in New and timeout of one connect in
+// ConnectContext. Default is 5 seconds.
+type ConnectTimeout time.Duration
+
+// ConnectAttempts parameter type sets max number of handshake packet sends
+// in connect. It sets default in New and attempts of one connect in
+// ConnectContext. Zero value retransmits handshake packets until timeout.
+type ConnectAttempts int
+
 type connect struct {
-	connects map[string]*connectData // Connections map
-	m        sync.RWMutex            // Connections maps mutex
+	connects map[string]*connectData   // Connections map
+	pending  map[string]*handshake     // Servers handshakes wait client answer
+	legacy   map[string]*Channel       // Servers legacy channels wait client answer
+	answers  map[string]*connectAnswer // Servers last handshake answers
+	m        sync.RWMutex              // Connections maps mutex
 }
 
 type connectData struct {
-	uuid string
-	wch  chan *connectData
-	ch   *Channel
+	uuid   string
+	connID uint32     // Clients connection ID
+	hs     *handshake // Clients X25519 handshake, nil in legacy handshake
+	wch    chan *connectData
+	ch     *Channel
+	err    error             // Connect error
+	cp     connectPacketData // Connect packet data
+	retry  bool              // Connect packet resent with retry cookie
+	packet []byte            // Last handshake packet, resent until connected
+	hello  []byte            // Clients hello data
+	ticket *sessionTicket    // Session ticket of resumed connect
+}
+
+// connectAnswer is servers last handshake answer to client, it resent when
+// client retransmits its handshake packet
+type connectAnswer struct {
+	addr   string // Client address
+	status int    // Answer packet status
+	data   []byte // Marshalled answer packet
 }
 
+// ErrConnectTimeout returned by Connect when peer does not answer during
+// connect timeout or connect attempts
+var ErrConnectTimeout = errors.New("can't connect to peer during timeout")
+
+var (
+	errLegacyHandshake  = errors.New("legacy handshake is not allowed")
+	errConnectRateLimit = errors.New("connect rate limit exceeded")
+)
+
 type connectPacketData struct {
-	uuid []byte // Connection UUID
-	data []byte // Packet data
+	uuid     []byte         // Connection UUID
+	data     []byte         // Packet data
+	extended bool           // Packet data has options, protocol version 6 and later
+	options  connectOptions // Connect options
 }
 
+// connectOptions is connect options exchanged by protocol version 6 and later
+// peers in handshake
+type connectOptions struct {
+	connID    uint32       // Connection ID of packets sent to options sender
+	handshake uint8        // Handshake type
+	suites    CipherSuites // Offered or selected cipher suites
+	cookie    []byte       // Stateless retry cookie
+	hello     []byte       // Encrypted hello or reply data
+	ticket    []byte       // Session ticket
+	reject    []byte       // Servers proof of client rejection
+}
+
+// Connect options types
+const (
+	connectOptionConnID = iota + 1
+	connectOptionHandshake
+	connectOptionCipherSuites
+	connectOptionCookie
+	connectOptionHello
+	connectOptionTicket
+	connectOptionReject
+)
+
 // MarshalBinary marshal connection data
+//
+//	Binary connect data structure:
+//	+-------------+------+------+---------+--------------------+
+//	| UUID LEN u8 | UUID | DATA | OPTIONS | OPTIONS LEN uint16 |
+//	+-------------+------+------+---------+--------------------+
+//	OPTIONS, OPTIONS LEN: extended connect data only
 func (c *connectPacketData) MarshalBinary() (out []byte, err error) {
 	buf := new(bytes.Buffer)
 	le := binary.LittleEndian
@@ -48,6 +127,11 @@ func (c *connectPacketData) MarshalBinary() (out []byte, err error) {
 	binary.Write(buf, le, uint8(len(c.uuid)))
 	binary.Write(buf, le, c.uuid)
 	binary.Write(buf, le, c.data)
+	if c.extended {
+		options := c.options.marshal()
+		binary.Write(buf, le, options)
+		binary.Write(buf, le, uint16(len(options)))
+	}
 
 	out = buf.Bytes()
 	return
@@ -56,6 +140,20 @@ func (c *connectPacketData) MarshalBinary() (out []byte, err error) {
 // UnmarshalBinary unmarshal connection data
 func (c *connectPacketData) UnmarshalBinary(data []byte) (err error) {
 
+	// Get options from the end of extended connect data. Old peers parse
+	// options as a tail of data and ignore it
+	if c.extended {
+		var options []byte
+		data, options, err = c.splitOptions(data)
+		if err != nil {
+			return
+		}
+		err = c.options.unmarshal(options)
+		if err != nil {
+			return
+		}
+	}
+
 	buf := bytes.NewReader(data)
 	le := binary.LittleEndian
 
@@ -81,73 +179,317 @@ func (c *connectPacketData) UnmarshalBinary(data []byte) (err error) {
 	return
 }
 
-// Connect to tru channel (remote peer) by address
-func (tru *Tru) Connect(addr string, reader ...ReaderFunc) (ch *Channel, err error) {
+// splitOptions split extended connect data to data and options
+func (c *connectPacketData) splitOptions(in []byte) (data, options []byte, err error) {
+	if len(in) < 2 {
+		err = errors.New("wrong connect options length")
+		return
+	}
+	l := len(in) - 2
+	optionsLen := int(binary.LittleEndian.Uint16(in[l:]))
+	if optionsLen > l {
+		err = errors.New("wrong connect options length")
+		return
+	}
+	data, options = in[:l-optionsLen], in[l-optionsLen:l]
+	return
+}
 
-	// Generate RSA key
-	c, err := tru.newCrypt()
-	if err != nil {
+// marshal connect options
+//
+//	Options structure, list of options:
+//	+-------------+------------+-------+
+//	| TYPE uint8  | LEN uint8  | VALUE |
+//	+-------------+------------+-------+
+func (o connectOptions) marshal() (out []byte) {
+	le := binary.LittleEndian
+	if o.connID != 0 {
+		out = append(out, connectOptionConnID, 4)
+		out = le.AppendUint32(out, o.connID)
+	}
+	if o.handshake != handshakeRSA {
+		out = append(out, connectOptionHandshake, 1, o.handshake)
+	}
+	if len(o.suites) > 0 {
+		out = append(out, connectOptionCipherSuites, uint8(len(o.suites)))
+		out = append(out, o.suites.bytes()...)
+	}
+	if len(o.cookie) > 0 {
+		out = append(out, connectOptionCookie, uint8(len(o.cookie)))
+		out = append(out, o.cookie...)
+	}
+	if len(o.ticket) > 0 && len(o.ticket) <= 0xFF {
+		out = append(out, connectOptionTicket, uint8(len(o.ticket)))
+		out = append(out, o.ticket...)
+	}
+	if len(o.reject) > 0 {
+		out = append(out, connectOptionReject, uint8(len(o.reject)))
+		out = append(out, o.reject...)
+	}
+
+	// Hello data is longer than option value, so it split to many hello
+	// options
+	for hello := o.hello; len(hello) > 0; {
+		n := min(len(hello), 0xFF)
+		out = append(out, connectOptionHello, uint8(n))
+		out = append(out, hello[:n]...)
+		hello = hello[n:]
+	}
+	return
+}
+
+// unmarshal connect options, unknown options skipped
+func (o *connectOptions) unmarshal(data []byte) (err error) {
+	le := binary.LittleEndian
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return errors.New("wrong connect option length")
+		}
+		typ, value := data[0], data[2:2+int(data[1])]
+		data = data[2+len(value):]
+
+		switch typ {
+		case connectOptionConnID:
+			if len(value) != 4 {
+				return errors.New("wrong connection id option")
+			}
+			o.connID = le.Uint32(value)
+		case connectOptionHandshake:
+			if len(value) != 1 {
+				return errors.New("wrong handshake option")
+			}
+			o.handshake = value[0]
+		case connectOptionCipherSuites:
+			o.suites = make(CipherSuites, len(value))
+			for i := range value {
+				o.suites[i] = CipherSuite(value[i])
+			}
+		case connectOptionCookie:
+			o.cookie = append([]byte(nil), value...)
+		case connectOptionHello:
+			o.hello = append(o.hello, value...)
+		case connectOptionTicket:
+			o.ticket = append([]byte(nil), value...)
+		case connectOptionReject:
+			o.reject = append([]byte(nil), value...)
+		}
+	}
+	return
+}
+
+// Connect to tru channel (remote peer) by address. Options are the same as
+// in ConnectContext
+func (tru *Tru) Connect(addr string, opts ...interface{}) (ch *Channel, err error) {
+	return tru.ConnectContext(context.Background(), addr, opts...)
+}
+
+// ConnectContext connect to tru channel (remote peer) by address. Handshake
+// packets are retransmitted with backoff until channel connected, context
+// done, or connect timeout or attempts expired. Options by type:
+//
+//	tru.ReaderFunc:      channel reader callback function
+//	tru.ConnectTimeout:  time to wait connection established
+//	tru.ConnectAttempts: max number of handshake packet sends
+//	tru.HelloData:       hello data sent to server in handshake
+func (tru *Tru) ConnectContext(ctx context.Context, addr string,
+	opts ...interface{}) (ch *Channel, err error) {
+
+	// Parse options
+	var reader ReaderFunc
+	var hello HelloData
+	timeout, attempts := tru.connectTimeout, tru.connectAttempts
+	for _, o := range opts {
+		switch v := o.(type) {
+		case func(ch *Channel, pac *Packet, err error) (processed bool):
+			reader = v
+		case ReaderFunc:
+			reader = v
+		case ConnectTimeout:
+			timeout = v
+		case ConnectAttempts:
+			attempts = v
+		case HelloData:
+			hello = v
+		}
+	}
+	if len(hello) > helloMaxLen {
+		err = ErrHelloTooLong
 		return
 	}
-	pub, err := c.publicKeyToBytes(&c.privateKey.PublicKey)
+	if timeout <= 0 {
+		timeout = ConnectTimeout(waitConnectionTimeout)
+	}
+
+	// Resolve UDP address
+	udpaddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return
 	}
 
-	// Create uuid and connect packet
+	// Create uuid and connect packet. Connect packet has max protocol version
+	// in header and clients connection id, handshake type and cipher suites
+	// in options
 	uuid := uuid.New().String()
-	cp := connectPacketData{[]byte(uuid), pub}
-	data, err := cp.MarshalBinary()
-	if err != nil {
-		return
+	connID := tru.newConnID()
+	cp := connectPacketData{uuid: []byte(uuid)}
+	cp.extended = tru.version >= protocolVersion6
+	cp.options.connID = connID
+	cp.options.suites = tru.cipherSuites
+
+	// Connect packet data is clients ephemeral X25519 key, or RSA public key
+	// in legacy handshake
+	var hs *handshake
+	if tru.legacyHandshake {
+		var c *crypt
+		c, err = tru.newCrypt()
+		if err != nil {
+			return
+		}
+		cp.data, err = c.publicKeyToBytes(&c.privateKey.PublicKey)
+	} else {
+		hs, err = newHandshake(uuid, false)
+		if err == nil {
+			hs.suites = tru.cipherSuites.bytes()
+			cp.data = hs.public()
+			cp.options.handshake = handshakeX25519
+		}
 	}
-	pac, err := tru.newPacket().SetStatus(statusConnect).SetData(data).MarshalBinary()
 	if err != nil {
 		return
 	}
 
-	// Create wait connection channel and save connection data to map
-	wch := tru.connect.add(uuid)
+	// Resume session by session ticket of this address. Legacy handshake
+	// client resumes session by X25519 handshake too
+	var st *sessionTicket
+	if len(hello) == 0 {
+		rhs := hs
+		if rhs == nil {
+			rhs, err = newHandshake(uuid, false)
+			if err != nil {
+				return
+			}
+			rhs.suites = tru.cipherSuites.bytes()
+		}
+		var ok bool
+		if st, ok = tru.resume(udpaddr, &cp, rhs); ok {
+			hs = rhs
+		}
+	}
+
+	// Save connection data to map
+	cd := tru.connect.add(uuid, connID, hs, cp)
+	cd.hello, cd.ticket = hello, st
 	defer tru.connect.delete(uuid)
-	defer close(wch)
 
 	// Send connect message
-	_, err = tru.WriteTo(pac, addr)
+	pac, err := tru.connectPacket(cp)
+	if err != nil {
+		return
+	}
+	err = tru.connect.writeHandshake(tru, cd, pac, udpaddr)
 	if err != nil {
 		return
 	}
 
-	// Wait answer to connect message or timeout
-	ch, err = tru.connect.wait(wch)
+	// Wait answer to connect message, retransmit handshake packets
+	ch, err = tru.connect.wait(ctx, tru, cd, udpaddr, time.Duration(timeout),
+		int(attempts))
 	if err != nil {
 		return
 	}
 
 	// Add reader to channel
-	if len(reader) > 0 {
-		ch.reader = reader[0]
+	if reader != nil {
+		ch.reader = reader
 	}
 	return
 }
 
-// wait channel connected or timeout
-func (c *connect) wait(wch chan *connectData) (ch *Channel, err error) {
-	select {
-	case cd := <-wch:
-		ch = cd.ch
+// connectPacket create connect packet with max protocol version
+func (tru *Tru) connectPacket(cp connectPacketData) (pac *Packet, err error) {
+	data, err := cp.MarshalBinary()
+	if err != nil {
 		return
-	case <-time.After(waitConnectionTimeout):
-		err = errors.New("can't connect to peer during timeout")
+	}
+	pac = tru.newPacket().SetStatus(statusConnect).SetData(data)
+	pac.version = tru.version
+	return
+}
+
+// writeHandshake write clients handshake packet to address and save it in
+// connection data to retransmit until connected
+func (c *connect) writeHandshake(tru *Tru, cd *connectData, pac *Packet,
+	addr net.Addr) (err error) {
+
+	data, err := pac.MarshalBinary()
+	if err != nil {
 		return
 	}
+	c.m.Lock()
+	cd.packet = data
+	c.m.Unlock()
+	_, err = tru.WriteTo(data, addr)
+	return
+}
+
+// wait channel connected, context done, timeout or attempts expired. Last
+// handshake packet retransmitted with exponential backoff while wait
+func (c *connect) wait(ctx context.Context, tru *Tru, cd *connectData,
+	addr net.Addr, timeout time.Duration, attempts int) (ch *Channel, err error) {
+
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := connectBackoffMin
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for sent := 1; ; {
+		select {
+		case cd := <-cd.wch:
+			ch, err = cd.ch, cd.err
+			return
+
+		case <-tctx.Done():
+			err = ctx.Err()
+			if err == nil {
+				err = ErrConnectTimeout
+			}
+			return
+
+		case <-timer.C:
+			if attempts > 0 && sent >= attempts {
+				err = ErrConnectTimeout
+				return
+			}
+			c.m.RLock()
+			data := cd.packet
+			c.m.RUnlock()
+			tru.WriteTo(data, addr)
+			sent++
+			backoff = min(2*backoff, connectBackoffMax)
+			timer.Reset(backoff)
+		}
+	}
+}
+
+// done send connection data to client connect wait channel. It does not
+// wait if connection data already sent by retransmitted packet
+func (c *connect) done(cd *connectData) {
+	select {
+	case cd.wch <- cd:
+	default:
+	}
 }
 
 // add add connection data to connections map
-func (c *connect) add(uuid string) (wch chan *connectData) {
+func (c *connect) add(uuid string, connID uint32, hs *handshake,
+	cp connectPacketData) (cd *connectData) {
 	c.m.Lock()
 	defer c.m.Unlock()
-	wch = make(chan *connectData)
-	c.connects[uuid] = &connectData{uuid, wch, nil}
+	cd = &connectData{uuid: uuid, connID: connID, hs: hs,
+		wch: make(chan *connectData, 1), cp: cp}
+	c.connects[uuid] = cd
 	return
 }
 
@@ -174,16 +516,86 @@ func (c *connect) serve(tru *Tru, addr net.Addr, pac *Packet) (err error) {
 	// public key
 	case statusConnect:
 
+		// Limit connect packets rate from source ip
+		if !tru.retry.allow(addr) {
+			tru.limits.connect.Add(1)
+			err = errConnectRateLimit
+			return
+		}
 		// Unmarshal received data
-		cp := connectPacketData{}
+		cp := connectPacketData{extended: pac.version >= protocolVersion6}
 		err = cp.UnmarshalBinary(pac.Data())
 		if err != nil {
 			return
 		}
 
+		// Send retry answer if connect packet has not valid cookie
+		var processed bool
+		if processed, err = c.serveRetry(tru, addr, pac, cp); processed {
+			return
+		}
+		tru.amplification.received(addr, pac.Len())
+
+		// Resend answer to retransmitted connect packet
+		if processed, err = c.resendAnswer(tru, addr, string(cp.uuid),
+			statusConnectServerAnswer); processed {
+			return
+		}
+
+		// When got connect packet from existing channel we destroy this
+		// channel first becaus client reconnected
+		if ch, ok := tru.getChannel(addr.String()); ok && !pac.longHeader() {
+			ch.destroy(fmt.Sprint("channel reconnect, destroy ", ch.Addr().String()))
+		}
+
+		// Negotiate protocol version and cipher suite
+		header := channelHeader{version: min(tru.version, pac.version)}
+		if header.version >= protocolVersion6 {
+			header.connID = tru.newConnID()
+			header.peerConnID = cp.options.connID
+			header.suite, err = tru.selectCipherSuite(cp.options.suites)
+			if err != nil {
+				return
+			}
+		}
+
+		// Resume session by ticket, or continue full X25519 handshake with
+		// clients ephemeral key
+		if cp.options.handshake == handshakeResume {
+			if len(cp.data) != handshakeKeyLen+sha256.Size {
+				err = errHandshake
+				return
+			}
+			if processed, err = c.serveResume(tru, addr, cp, header); processed {
+				return
+			}
+			cp.data = cp.data[:handshakeKeyLen]
+			cp.options.handshake = handshakeX25519
+		}
+
+		// Answer to X25519 handshake, or continue legacy handshake. Version 5
+		// peers use legacy handshake only, so it accepted from them for
+		// rolling upgrades. Version 6 peers use legacy handshake if allowed
+		if cp.options.handshake == handshakeX25519 {
+			err = c.serveHello(tru, addr, cp, header)
+			return
+		}
+		if !tru.legacyHandshake && pac.version >= protocolVersion6 {
+			err = errLegacyHandshake
+			return
+		}
+		err = tru.authorize(addr, nil, nil)
+		if err != nil {
+			return
+		}
+		err = tru.legacyPrivateKey()
+		if err != nil {
+			return
+		}
+
 		// Create new tru channel
 		var ch *Channel
-		ch, err = tru.newChannel(addr, true)
+		ch, err = tru.newChannel(addr, header, true)
 		if err != nil {
 			return
 		}
@@ -205,31 +617,98 @@ func (c *connect) serve(tru *Tru, addr net.Addr, pac *Packet) (err error) {
 		if err != nil {
 			return
 		}
+		cp.extended = header.version >= protocolVersion6
+		cp.options = connectOptions{connID: header.connID}
+		if header.version >= protocolVersion6 {
+			cp.options.suites = CipherSuites{header.suite}
+		}
 		var data []byte
 		data, err = cp.MarshalBinary()
 
-		// Create packet and send it to tru channel
-		pac = tru.newPacket().SetStatus(statusConnectServerAnswer).SetData(data)
-		ch.writeToSender(pac)
+		if err != nil {
+			return
+		}
+
+		// Create packet with negotiated protocol version and send it to
+		// unvalidated client address
+		data, err = ch.newPacket().SetStatus(statusConnectServerAnswer).
+			SetData(data).MarshalBinary()
+		if err != nil {
+			return
+		}
+		c.addAnswer(addr, string(cp.uuid), statusConnectServerAnswer, data)
+		err = tru.writeToUnvalidated(data, addr)
+		if err != nil {
+			ch.destroy(fmt.Sprint("channel amplification limit, destroy ", addr.String()))
+			return
+		}
+		c.addLegacy(string(cp.uuid), ch)
 
 	// Got by client. Server answer to client with statusConnectServerAnswer
 	// packet with server public key
 	case statusConnectServerAnswer:
 
 		// Unmarshal received data
-		cp := connectPacketData{}
+		cp := connectPacketData{extended: pac.version >= protocolVersion6}
 		err = cp.UnmarshalBinary(pac.Data())
 		if err != nil {
 			return
 		}
 
 		// Get connection data from connection map and create new tru channel
+		// with protocol version selected by server
+		// Late answers to retransmitted packets of finished connect ignored
 		cd, ok := c.get(string(cp.uuid))
 		if !ok {
-			err = errors.New("wrong connect server answer packet")
+			log.Debugv.Println("skip connect server answer from", addr.String())
+			return
+		}
+		if pac.version > tru.version {
+			err = ErrWrongPacketVersion
+			return
+		}
+
+		// Skip server answer to retransmitted connect packet
+		if cd.ch != nil {
+			return
+		}
+
+		// Resend connect packet with cookie of servers retry answer
+		if len(cp.options.cookie) > 0 {
+			err = c.retryConnect(tru, addr, cd, cp.options.cookie)
+			return
+		}
+		header := channelHeader{version: pac.version}
+		if header.version >= protocolVersion6 {
+			header.connID = cd.connID
+			header.peerConnID = cp.options.connID
+			header.suite, err = tru.selectCipherSuite(cp.options.suites)
+			if err != nil {
+				return
+			}
+		}
+
+		// Hello data can't be sent to protocol version 5 server
+		if len(cd.hello) > 0 && header.version < protocolVersion6 {
+			cd.err = errHelloVersion
+			c.done(cd)
 			return
 		}
-		cd.ch, err = tru.newChannel(addr)
+
+		// Finish resumed session handshake
+		if cp.options.handshake == handshakeResume {
+			err = c.serveResumeAnswer(tru, addr, cp, cd, header)
+			return
+		}
+
+		// Continue X25519 handshake
+		if cd.hs != nil {
+			err = c.serveServerAnswer(tru, addr, cp, cd, header)
+			return
+		}
+
+		// Create tru channel and continue legacy handshake
+		cd.ch, err = tru.newChannel(addr, header)
 		if err != nil {
 			return
 		}
@@ -253,32 +732,58 @@ func (c *connect) serve(tru *Tru, addr net.Addr, pac *Packet) (err error) {
 			return
 		}
 
-		// Create output connect packet data
+		// Create output connect packet data with encrypted hello data
+		cp.options = connectOptions{}
+		if len(cd.hello) > 0 {
+			cp.options.hello, err = sealHello(key, helloClientLabel, cp.uuid,
+				cd.hello)
+			if err != nil {
+				return
+			}
+		}
 		data, err = cp.MarshalBinary()
 		if err != nil {
 			return
 		}
 
-		// Create packet and send it to tru channel
-		pac = tru.newPacket().SetStatus(statusConnectClientAnswer).SetData(data)
-		cd.ch.writeToSender(pac)
-		cd.ch.setSesionKey(key)
+		// Set session key, create packet and send it to server
+		err = cd.ch.setPacketKey(key)
+		if err != nil {
+			return
+		}
+		pac = cd.ch.newPacket().SetStatus(statusConnectClientAnswer).SetData(data)
+		err = c.writeHandshake(tru, cd, pac, addr)
 
 	// Got by server. Client answer to server with statusConnectClientAnswer packet with
 	// current session key
 	case statusConnectClientAnswer:
 
 		// Unmarshal received data
-		cp := connectPacketData{}
+		cp := connectPacketData{extended: pac.version >= protocolVersion6}
 		err = cp.UnmarshalBinary(pac.Data())
 		if err != nil {
 			return
 		}
 
-		// Get channel
-		ch, ok := tru.getChannel(addr.String())
-		if !ok {
-			err = errors.New("connected channel does not exists")
+		// Resend connect done to retransmitted client answer
+		var processed bool
+		if processed, err = c.resendAnswer(tru, addr, string(cp.uuid),
+			statusConnectDone); processed {
+			return
+		}
+
+		// Finish X25519 handshake
+		if hs, ok := c.getPending(string(cp.uuid)); ok {
+			err = c.serveClientAnswer(tru, addr, cp, hs)
+			return
+		}
+
+		// Get channel created by legacy handshake of this connection. It
+		// has not session key until client answer received, so client
+		// answer can't change key of connected channel
+		ch, ok := c.getLegacy(string(cp.uuid))
+		if !ok || ch.Addr().String() != addr.String() || ch.ison() {
+			log.Debugv.Println("skip client answer from", addr.String())
 			return
 		}
 
@@ -288,39 +793,80 @@ func (c *connect) serve(tru *Tru, addr net.Addr, pac *Packet) (err error) {
 		if err != nil {
 			return
 		}
-		ch.setSesionKey(key)
+		c.deleteLegacy(string(cp.uuid))
+		err = ch.setPacketKey(key)
+		if err != nil {
+			return
+		}
+		tru.amplification.validate(addr)
 
-		// Create output connect packet data
+		// Get clients hello data and create output connect packet data
+		// with encrypted reply
+		var hello []byte
+		hello, err = openHello(key, helloClientLabel, cp.uuid, cp.options.hello)
+		if err != nil {
+			return
+		}
 		var data []byte
 		cp.data = nil
+		cp.extended = ch.header.version >= protocolVersion6
+		cp.options = connectOptions{ticket: tru.issueTicket(ch)}
+		cp.options.hello, err = tru.serveHelloData(ch, cp.uuid, hello)
+		if err != nil {
+			return
+		}
 		data, err = cp.MarshalBinary()
 		if err != nil {
 			return
 		}
 
-		// Create packet and send it to tru channel
-		pac = tru.newPacket().SetStatus(statusConnectDone).SetData(data)
-		ch.writeToSender(pac)
+		// Create packet and send it to client, channel connected when clients
+		// hello data processed
+		err = c.writeAnswer(tru, ch, string(cp.uuid), statusConnectDone, data)
+		if err != nil {
+			return
+		}
+		tru.connected(ch)
 
 	// Got by client. Server answer to client with statusConnectDone packet
 	case statusConnectDone:
 
 		// Unmarshal received data
-		cp := connectPacketData{}
+		cp := connectPacketData{extended: pac.version >= protocolVersion6}
 		err = cp.UnmarshalBinary(pac.Data())
 		if err != nil {
 			return
 		}
 
-		// Get connection data from connection map and get tru channel
+		// Get connection data from connection map, late answers to
+		// retransmitted packets of finished connect and connect done before
+		// client channel created ignored
 		cd, ok := c.get(string(cp.uuid))
-		if !ok {
-			err = errors.New("wrong connect done packet")
+		if !ok || cd.ch == nil {
+			log.Debugv.Println("skip connect done from", addr.String())
 			return
 		}
 
-		// Send connectData to client connect wait channel
-		cd.wch <- cd
+		// Server rejected client by authorize function
+		if cp.options.reject != nil {
+			if !validReject(cd.ch.sessionKey.bytes, cp) {
+				log.Debugv.Println("wrong reject from", addr.String())
+				return
+			}
+			cd.ch.destroy(fmt.Sprint("channel unauthorized, destroy ", addr.String()))
+			cd.err = ErrUnauthorized
+			c.done(cd)
+			return
+		}
+
+		// Get servers reply data and send connectData to client connect wait
+		// channel
+		if cd.ch.hello == nil {
+			cd.ch.hello, cd.err = openHello(cd.ch.sessionKey.bytes,
+				helloServerLabel, cp.uuid, cp.options.hello)
+			tru.saveTicket(addr, cd.ch, cp.options.ticket)
+		}
+		c.done(cd)
 
 	default:
 		err = errors.New("wrong packet status")
@@ -328,3 +874,88 @@ func (c *connect) serve(tru *Tru, addr net.Addr, pac *Packet) (err error) {
 
 	return
 }
+
+// writeAnswer write servers handshake answer to channel address and save it
+// to resend when client retransmits its handshake packet
+func (c *connect) writeAnswer(tru *Tru, ch *Channel, uuid string, status int,
+	data []byte) (err error) {
+
+	data, err = ch.newPacket().SetStatus(status).SetData(data).MarshalBinary()
+	if err != nil {
+		return
+	}
+	c.addAnswer(ch.Addr(), uuid, status, data)
+	_, err = tru.WriteTo(data, ch.Addr())
+	return
+}
+
+// addAnswer save servers last handshake answer, nil data saved when client
+// rejected. Answer removed after server connect timeout
+func (c *connect) addAnswer(addr net.Addr, uuid string, status int, data []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	a := &connectAnswer{addr: addr.String(), status: status, data: data}
+	c.answers[uuid] = a
+	time.AfterFunc(ServerConnectTimeout, func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.answers[uuid] == a {
+			delete(c.answers, uuid)
+		}
+	})
+}
+
+// addLegacy add server channel created in legacy handshake which wait client
+// answer. Channel removed if client does not answer during server connect
+// timeout
+func (c *connect) addLegacy(uuid string, ch *Channel) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.legacy[uuid] = ch
+	time.AfterFunc(ServerConnectTimeout, func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.legacy[uuid] == ch {
+			delete(c.legacy, uuid)
+		}
+	})
+}
+
+// getLegacy get server legacy handshake channel which wait client answer
+func (c *connect) getLegacy(uuid string) (ch *Channel, ok bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	ch, ok = c.legacy[uuid]
+	return
+}
+
+// deleteLegacy delete server legacy handshake channel
+func (c *connect) deleteLegacy(uuid string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.legacy, uuid)
+}
+
+// resendAnswer resend servers handshake answer with status to retransmitted
+// client handshake packet. It returns true if packet already processed:
+// answer with status or next handshake status saved
+func (c *connect) resendAnswer(tru *Tru, addr net.Addr, uuid string,
+	status int) (processed bool, err error) {
+
+	c.m.RLock()
+	a, ok := c.answers[uuid]
+	c.m.RUnlock()
+	if !ok || a.status < status {
+		return
+	}
+	processed = true
+	if a.addr != addr.String() || a.status != status || a.data == nil {
+		return
+	}
+	if status == statusConnectServerAnswer {
+		err = tru.writeToUnvalidated(a.data, addr)
+		return
+	}
+	_, err = tru.WriteTo(a.data, addr)
+	return
+}
@@ -0,0 +1,290 @@
+package tru
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+// dropConn is udp connection which drops sent packets selected by drop
+// function
+type dropConn struct {
+	net.PacketConn
+	drop    func(status int) bool // Return true to drop packet with status
+	dropped map[int]int           // Number of dropped packets by status
+	sync.Mutex
+}
+
+// newDropConn create udp connection which drops sent packets
+func newDropConn(t *testing.T, drop func(status int) bool) *dropConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dropConn{PacketConn: conn, drop: drop, dropped: make(map[int]int)}
+}
+
+// WriteTo write packet or drop it
+func (c *dropConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+	pac := new(Packet)
+	if pac.unmarshalHeader(data) == nil {
+		c.Lock()
+		drop := c.drop(pac.Status())
+		if drop {
+			c.dropped[pac.Status()]++
+		}
+		c.Unlock()
+		if drop {
+			return len(data), nil
+		}
+	}
+	return c.PacketConn.WriteTo(data, addr)
+}
+
+// dropFirst return drop function which drops first packet with status
+func dropFirst(status int) func(int) bool {
+	dropped := false
+	return func(s int) bool {
+		if s != status || dropped {
+			return false
+		}
+		dropped = true
+		return true
+	}
+}
+
+func TestConnectRetransmit(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	statuses := []int{
+		statusConnect,
+		statusConnectServerAnswer,
+		statusConnectClientAnswer,
+		statusConnectDone,
+	}
+	for _, legacy := range []LegacyHandshake{false, true} {
+		for _, status := range statuses {
+			t.Run(fmt.Sprintf("legacy %v drop status %d", legacy, status),
+				func(t *testing.T) {
+
+					received := make(chan struct{}, 1)
+					reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+						if err == nil {
+							received <- struct{}{}
+						}
+						return
+					}
+
+					drop := dropFirst(status)
+					sconn := newDropConn(t, drop)
+					server, err := New(0, reader, sconn, legacy, log)
+					if err != nil {
+						t.Fatalf("can't start server, err: %s", err)
+					}
+					defer server.Close()
+
+					cconn := newDropConn(t, drop)
+					client, err := New(0, cconn, legacy, log)
+					if err != nil {
+						t.Fatalf("can't start client, err: %s", err)
+					}
+					defer client.Close()
+
+					ch, err := client.Connect(sconn.LocalAddr().String())
+					if err != nil {
+						t.Fatalf("can't connect to server, err: %s", err)
+					}
+					sconn.Lock()
+					cconn.Lock()
+					dropped := sconn.dropped[status] + cconn.dropped[status]
+					cconn.Unlock()
+					sconn.Unlock()
+					if dropped != 1 {
+						t.Fatal("handshake packet does not dropped")
+					}
+					if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+						t.Fatalf("WriteTo err: %s", err)
+					}
+					select {
+					case <-received:
+					case <-time.After(5 * time.Second):
+						t.Fatal("packet not received")
+					}
+					n := 0
+					server.ForEachChannel(func(*Channel) { n++ })
+					if n != 1 {
+						t.Errorf("wrong number of server channels: %d", n)
+					}
+				})
+		}
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	server, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+	addr := fmt.Sprintf("127.0.0.1:%d", server.LocalAddr().(*net.UDPAddr).Port)
+
+	// Client connect packets are always dropped
+	conn := newDropConn(t, func(status int) bool { return status == statusConnect })
+	client, err := New(0, conn, ConnectTimeout(time.Second), log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+
+	// Default timeout set in New
+	start := time.Now()
+	if _, err = client.Connect(addr); err != ErrConnectTimeout {
+		t.Errorf("wrong connect error: %v", err)
+	}
+	if d := time.Since(start); d < time.Second || d > 2*time.Second {
+		t.Errorf("wrong connect timeout: %v", d)
+	}
+
+	// Timeout and attempts of one connect
+	start = time.Now()
+	conn.Lock()
+	conn.dropped[statusConnect] = 0
+	conn.Unlock()
+	_, err = client.ConnectContext(context.Background(), addr, ConnectAttempts(2))
+	if err != ErrConnectTimeout {
+		t.Errorf("wrong connect error: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("wrong connect attempts time: %v", d)
+	}
+	if n := conn.dropped[statusConnect]; n != 2 {
+		t.Errorf("wrong number of connect attempts: %d", n)
+	}
+
+	// Context cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.ConnectContext(ctx, addr, ConnectTimeout(time.Minute))
+	if err != context.DeadlineExceeded {
+		t.Errorf("wrong connect error: %v", err)
+	}
+
+	// Connect done received before server answer ignored
+	sconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	go func() {
+		buf := make([]byte, readBufferLen)
+		for {
+			n, from, err := sconn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pac := new(Packet)
+			if pac.UnmarshalBinary(buf[:n]) != nil || pac.Status() != statusConnect {
+				continue
+			}
+			cp := connectPacketData{extended: pac.version >= protocolVersion6}
+			if cp.UnmarshalBinary(pac.Data()) != nil {
+				continue
+			}
+			data, _ := (&connectPacketData{uuid: cp.uuid, extended: cp.extended}).MarshalBinary()
+			p := server.newPacket().SetStatus(statusConnectDone).SetData(data)
+			p.version = pac.version
+			data, _ = p.MarshalBinary()
+			sconn.WriteTo(data, from)
+		}
+	}()
+	client2, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client2.Close()
+	ch, err := client2.Connect(sconn.LocalAddr().String(),
+		ConnectTimeout(500*time.Millisecond))
+	if ch != nil || err != ErrConnectTimeout {
+		t.Errorf("wrong connect done before server answer: %v, %v", ch, err)
+	}
+}
+
+func TestLegacyClientAnswer(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	connected := make(chan *Channel, 10)
+	connectFunc := func(ch *Channel, err error) { connected <- ch }
+	server, err := New(0, ConnectFunc(connectFunc), LegacyHandshake(true), log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+
+	client, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+	addr := fmt.Sprintf("127.0.0.1:%d", server.LocalAddr().(*net.UDPAddr).Port)
+
+	ch, err := client.Connect(addr)
+	if err != nil {
+		t.Fatalf("can't connect to server, err: %s", err)
+	}
+	defer ch.Close()
+	var sch *Channel
+	select {
+	case sch = <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not connected")
+	}
+	key := append([]byte(nil), sch.sessionKey.bytes...)
+
+	// Legacy client answer with chosen key sent from address of X25519
+	// channel does not change channels key
+	for _, uuid := range []string{"uuid", ""} {
+		data, err := sch.encrypt(&server.privateKey.PublicKey, []byte("chosen session key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp := connectPacketData{uuid: []byte(uuid), data: data, extended: true}
+		data, _ = cp.MarshalBinary()
+		p := client.newPacket().SetStatus(statusConnectClientAnswer).SetData(data)
+		p.version = protocolVersion6
+		data, _ = p.MarshalBinary()
+		client.WriteTo(data, addr)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !bytes.Equal(key, sch.sessionKey.bytes) {
+		t.Error("channel key changed by legacy client answer")
+	}
+	n := 0
+	server.ForEachChannel(func(c *Channel) {
+		if c == sch {
+			n++
+		}
+	})
+	if n != 1 {
+		t.Error("channel destroyed by legacy client answer")
+	}
+	if len(connected) != 0 {
+		t.Error("channel connected again by legacy client answer")
+	}
+	if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+		t.Errorf("WriteTo err: %s", err)
+	}
+}
@@ -28,23 +28,31 @@ import (
 
 type crypt struct {
 	privateKey *rsa.PrivateKey // RSA private key
+	aead       *packetAEAD     // Packet AEAD, nil in protocol version 5 channels
 	sessionKey                 // Current session key
 }
 
 const bitSize = 1024 // 896
 
-// newCrypt create and initialize trudp crypt module
+// newCrypt create and initialize trudp crypt module. The private key used in
+// legacy handshake only
 func (tru *Tru) newCrypt() (c *crypt, err error) {
 	c = new(crypt)
-	if tru.privateKey != nil {
-		c.privateKey = tru.privateKey
-		return
-	}
-	c.privateKey, err = GeneratePrivateKey()
-	if err != nil {
-		return
+	tru.privateKeyMu.Lock()
+	c.privateKey = tru.privateKey
+	tru.privateKeyMu.Unlock()
+	return
+}
+
+// legacyPrivateKey generate common private key of legacy handshake if it is
+// not generated yet. Server without legacy handshake generates the key when
+// first version 5 peer connects
+func (tru *Tru) legacyPrivateKey() (err error) {
+	tru.privateKeyMu.Lock()
+	defer tru.privateKeyMu.Unlock()
+	if tru.privateKey == nil {
+		tru.privateKey, err = GeneratePrivateKey()
 	}
-	tru.privateKey = c.privateKey
 	return
 }
 
@@ -92,8 +100,8 @@ func (c crypt) encryptAES(key []byte, data []byte) (out []byte, err error) {
 	return
 }
 
-// decryptAES decrypt data using AES
-func (c crypt) decryptAES(key []byte, data []byte) (out []byte, err error) {
+// decryptAES decrypt data using AES and append it to dst
+func (c crypt) decryptAES(dst, key []byte, data []byte) (out []byte, err error) {
 
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
@@ -114,18 +122,18 @@ func (c crypt) decryptAES(key []byte, data []byte) (out []byte, err error) {
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 
 	//Decrypt the data
-	out, err = aesGCM.Open(nil, nonce, ciphertext, nil)
+	out, err = aesGCM.Open(dst, nonce, ciphertext, nil)
 
 	return
 }
 
 // encryptPacketData encryp packet data with packet key
-func (c crypt) encryptPacketData(id int, data []byte) (out []byte, err error) {
+func (c crypt) encryptPacketData(id int, epoch uint32, data []byte) (out []byte, err error) {
 	if !c.ison() {
 		return data, nil
 	}
 	l := len(data)
-	key := c.packetKey(uint32(id), l)
+	key := c.packetKey(uint32(id), epoch, l)
 	if l <= 64 {
 		out = make([]byte, len(data))
 		copy(out, data)
@@ -137,18 +145,19 @@ func (c crypt) encryptPacketData(id int, data []byte) (out []byte, err error) {
 	return
 }
 
-// decryptPacketData decrypt packet data with packet key
-func (c crypt) decryptPacketData(id int, data []byte) (out []byte, err error) {
+// decryptPacketData decrypt packet data with packet key and append it to dst
+func (c crypt) decryptPacketData(dst []byte, id int, epoch uint32, data []byte) (out []byte, err error) {
 	if !c.ison() {
-		return data, nil
+		return append(dst, data...), nil
 	}
 	l := len(data)
-	key := c.packetKey(uint32(id), l)
+	key := c.packetKey(uint32(id), epoch, l)
 	if l <= 64 {
-		c.xorEncryptDecrypt(data, key)
-		return data, nil
+		out = append(dst, data...)
+		c.xorEncryptDecrypt(out[len(dst):], key)
+		return
 	}
-	out, err = c.decryptAES(key, data)
+	out, err = c.decryptAES(dst, key, data)
 	return
 }
 
@@ -250,10 +259,16 @@ func (c crypt) ison() bool {
 	return len(c.sessionKey.bytes) > 0
 }
 
-func (k sessionKey) packetKey(id uint32, len int) []byte {
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, id)
-	key := append(k.bytes, b...)
+// packetKey return key of packet with id and id epoch. Packet key depends of
+// 64 bit packet number, epoch and id, so key does not repeat when id wrapped.
+// Zero epoch keys are the same as in protocol version 5.
+func (k sessionKey) packetKey(id, epoch uint32, len int) []byte {
+	key := make([]byte, 0, 64)
+	key = append(key, k.bytes...)
+	key = binary.LittleEndian.AppendUint32(key, id)
+	if epoch != 0 {
+		key = binary.LittleEndian.AppendUint32(key, epoch)
+	}
 	// Hash key depend of data len
 	//   md5:    16 byte
 	//   sha1:   20 byte
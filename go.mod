@@ -5,5 +5,7 @@ go 1.21
 require (
 	github.com/google/uuid v1.3.0
 	github.com/kirill-scherba/stable v0.0.8
-	golang.org/x/sys v0.11.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.13.0
 )
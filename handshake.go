@@ -0,0 +1,396 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Handshake module
+
+package tru
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Handshake uses Noise XX message pattern with signatures (SIGMA-I) over the
+// four connect statuses:
+//
+//	statusConnect:             -> e
+//	statusConnectServerAnswer: <- e, ee, AEAD(s, sig)
+//	statusConnectClientAnswer: -> AEAD(s, sig)
+//	statusConnectDone:         <-
+//
+// Peers exchange ephemeral X25519 keys, derive handshake and session keys
+// from ephemeral Diffie-Hellman secret and handshake transcript, and prove
+// its long term Ed25519 identities by signing the transcript. Ephemeral keys
+// give forward secrecy, signatures give mutual authentication. The server
+// creates channel when client identity verified.
+
+// LegacyHandshake parameter type switch on RSA handshake of protocol version
+// 5. Client with legacy handshake connects by RSA handshake, so it can
+// connect to version 5 peers. Server with legacy handshake accepts both RSA
+// and X25519 handshakes from version 6 peers. By default only X25519
+// handshake used, but server accepts RSA handshake from version 5 peers.
+type LegacyHandshake bool
+
+// Handshake types
+const (
+	handshakeRSA    = iota // Legacy RSA handshake
+	handshakeX25519        // X25519 key exchange with Ed25519 identities
+	handshakeResume        // Abbreviated handshake by session ticket
+)
+
+const (
+	handshakeProtocol  = "TRU_XX_25519_Ed25519_AESGCM_SHA256"
+	handshakeKeyLen    = 32
+	handshakeSignedLen = ed25519.PublicKeySize + ed25519.SignatureSize
+)
+
+var errHandshake = errors.New("handshake authentication failed")
+
+// handshake is X25519 handshake state
+type handshake struct {
+	ephemeral  *ecdh.PrivateKey  // Ephemeral key
+	transcript []byte            // Handshake transcript hash
+	keys       handshakeKeys     // Keys derived in handshake
+	peerKey    ed25519.PublicKey // Peer identity key
+	suites     []byte            // Cipher suites offered by client
+	suite      CipherSuite       // Cipher suite selected by server
+	header     channelHeader     // Channel header negotiated by server
+	uuid       string            // Connection UUID
+	addr       string            // Client address
+	server     bool              // Server side handshake
+}
+
+// handshakeKeys is keys derived in handshake
+type handshakeKeys struct {
+	server  []byte // Server answer encryption key
+	client  []byte // Client answer encryption key
+	session []byte // Channel session key
+}
+
+// newHandshake create client or server handshake state with new ephemeral
+// key
+func newHandshake(uuid string, server bool) (h *handshake, err error) {
+	h = &handshake{uuid: uuid, server: server}
+	h.ephemeral, err = ecdh.X25519().GenerateKey(rand.Reader)
+	return
+}
+
+// public return ephemeral public key
+func (h *handshake) public() []byte {
+	return h.ephemeral.PublicKey().Bytes()
+}
+
+// derive derive handshake and session keys from client and server ephemeral
+// public keys
+func (h *handshake) derive(client, server []byte) (err error) {
+
+	// Ephemeral Diffie-Hellman secret
+	peer := server
+	if h.server {
+		peer = client
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return
+	}
+	secret, err := h.ephemeral.ECDH(peerKey)
+	if err != nil {
+		return
+	}
+
+	// Transcript hash
+	hash := sha256.New()
+	hash.Write([]byte(handshakeProtocol))
+	hash.Write([]byte(h.uuid))
+	hash.Write(client)
+	hash.Write(server)
+	hash.Write(h.suites)
+	hash.Write([]byte{uint8(h.suite)})
+	h.transcript = hash.Sum(nil)
+
+	// Keys
+	kdf := hkdf.New(sha256.New, secret, h.transcript, []byte(handshakeProtocol))
+	for _, key := range []*[]byte{&h.keys.server, &h.keys.client, &h.keys.session} {
+		*key = make([]byte, handshakeKeyLen)
+		if _, err = io.ReadFull(kdf, *key); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// seal sign handshake transcript by identity key and encrypt public identity
+// key and signature. The bind parameter is signed with transcript
+func (h *handshake) seal(key []byte, identity ed25519.PrivateKey, label string,
+	bind []byte) (out []byte, err error) {
+
+	aead, err := newHandshakeAEAD(key)
+	if err != nil {
+		return
+	}
+	msg := append(append([]byte(label), h.transcript...), bind...)
+	plain := append([]byte(identity.Public().(ed25519.PublicKey)),
+		ed25519.Sign(identity, msg)...)
+	out = aead.Seal(nil, make([]byte, aead.NonceSize()), plain, h.transcript)
+	return
+}
+
+// open decrypt peers public identity key and signature and verify signature
+// of handshake transcript. It sets peerKey when signature valid
+func (h *handshake) open(key []byte, data []byte, label string,
+	bind []byte) (err error) {
+
+	aead, err := newHandshakeAEAD(key)
+	if err != nil {
+		return
+	}
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), data, h.transcript)
+	if err != nil || len(plain) != handshakeSignedLen {
+		return errHandshake
+	}
+	peerKey := ed25519.PublicKey(plain[:ed25519.PublicKeySize])
+	msg := append(append([]byte(label), h.transcript...), bind...)
+	if !ed25519.Verify(peerKey, msg, plain[ed25519.PublicKeySize:]) {
+		return errHandshake
+	}
+	h.peerKey = peerKey
+	return
+}
+
+// newHandshakeAEAD create handshake messages cipher. Each handshake key
+// encrypts one message, so zero nonce used
+func newHandshakeAEAD(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+// serveHello answer to clients connect packet of X25519 handshake. Server
+// sends its ephemeral key and signed identity, and waits clients answer
+// without creating channel
+func (c *connect) serveHello(tru *Tru, addr net.Addr, cp connectPacketData,
+	header channelHeader) (err error) {
+
+	// Drop connect packet when too many handshakes wait client answer
+	if c.pendingFull() {
+		tru.limits.pending.Add(1)
+		return errPendingLimit
+	}
+
+	hs, err := newHandshake(string(cp.uuid), true)
+	if err != nil {
+		return
+	}
+	hs.suites, hs.suite = cp.options.suites.bytes(), header.suite
+	err = hs.derive(cp.data, hs.public())
+	if err != nil {
+		return
+	}
+	sealed, err := hs.seal(hs.keys.server, tru.identity, "server", nil)
+	if err != nil {
+		return
+	}
+	hs.header = header
+	hs.addr = addr.String()
+	if !c.addPending(hs) {
+		tru.limits.pending.Add(1)
+		return errPendingLimit
+	}
+
+	// Create and send server answer packet
+	cp.data = append(hs.public(), sealed...)
+	cp.extended = header.version >= protocolVersion6
+	cp.options = connectOptions{connID: header.connID}
+	if header.version >= protocolVersion6 {
+		cp.options.suites = CipherSuites{header.suite}
+	}
+	data, err := cp.MarshalBinary()
+	if err != nil {
+		return
+	}
+	pac := tru.newPacket().SetStatus(statusConnectServerAnswer).SetData(data)
+	pac.version = header.version
+	data, err = pac.MarshalBinary()
+	if err != nil {
+		return
+	}
+	c.addAnswer(addr, hs.uuid, statusConnectServerAnswer, data)
+	err = tru.writeToUnvalidated(data, addr)
+	return
+}
+
+// serveServerAnswer verify servers identity, create client channel and send
+// clients signed identity
+func (c *connect) serveServerAnswer(tru *Tru, addr net.Addr,
+	cp connectPacketData, cd *connectData, header channelHeader) (err error) {
+
+	hs := cd.hs
+	if len(cp.data) < handshakeKeyLen {
+		return errHandshake
+	}
+	hs.suite = header.suite
+	err = hs.derive(hs.public(), cp.data[:handshakeKeyLen])
+	if err != nil {
+		return
+	}
+	err = hs.open(hs.keys.server, cp.data[handshakeKeyLen:], "server", nil)
+	if err != nil {
+		return
+	}
+
+	// Authorize server, connect fails at once if server rejected
+	err = tru.authorize(addr, hs.peerKey, nil)
+	if err != nil {
+		cd.err = err
+		c.done(cd)
+		return
+	}
+
+	// Create tru channel
+	cd.ch, err = tru.newChannel(addr, header)
+	if err != nil {
+		return
+	}
+	err = cd.ch.setPacketKey(hs.keys.session)
+	if err != nil {
+		return
+	}
+	cd.ch.peerKey = hs.peerKey
+
+	// Send client answer, client signs servers identity with transcript and
+	// sends encrypted hello data
+	cp.data, err = hs.seal(hs.keys.client, tru.identity, "client", hs.peerKey)
+	if err != nil {
+		return
+	}
+	cp.options = connectOptions{}
+	if len(cd.hello) > 0 {
+		cp.options.hello, err = sealHello(hs.keys.session, helloClientLabel,
+			cp.uuid, cd.hello)
+		if err != nil {
+			return
+		}
+	}
+	data, err := cp.MarshalBinary()
+	if err != nil {
+		return
+	}
+	pac := cd.ch.newPacket().SetStatus(statusConnectClientAnswer).SetData(data)
+	err = c.writeHandshake(tru, cd, pac, addr)
+	return
+}
+
+// serveClientAnswer verify clients identity, create server channel and send
+// connect done packet
+func (c *connect) serveClientAnswer(tru *Tru, addr net.Addr,
+	cp connectPacketData, hs *handshake) (err error) {
+
+	if hs.addr != addr.String() {
+		return errHandshake
+	}
+	err = hs.open(hs.keys.client, cp.data, "client", tru.PublicKey())
+	if err != nil {
+		return
+	}
+	hello, err := openHello(hs.keys.session, helloClientLabel, cp.uuid,
+		cp.options.hello)
+	if err != nil {
+		return
+	}
+	c.deletePending(hs.uuid)
+	tru.amplification.validate(addr)
+
+	// Authorize client with its hello data before channel created
+	err = tru.authorize(addr, hs.peerKey, hello)
+	if err != nil {
+		cp.data, cp.options = nil, connectOptions{}
+		c.writeReject(tru, addr, hs.header, statusConnectDone, hs.keys.session, cp)
+		return
+	}
+
+	// Create tru channel
+	ch, err := tru.newChannel(addr, hs.header, true)
+	if err != nil {
+		return
+	}
+	err = ch.setPacketKey(hs.keys.session)
+	if err != nil {
+		return
+	}
+	ch.peerKey = hs.peerKey
+
+	// Send connect done packet with encrypted reply data
+	cp.data = nil
+	cp.extended = hs.header.version >= protocolVersion6
+	cp.options = connectOptions{ticket: tru.issueTicket(ch)}
+	cp.options.hello, err = tru.serveHelloData(ch, cp.uuid, hello)
+	if err != nil {
+		return
+	}
+	data, err := cp.MarshalBinary()
+	if err != nil {
+		return
+	}
+	err = c.writeAnswer(tru, ch, hs.uuid, statusConnectDone, data)
+	if err != nil {
+		return
+	}
+	tru.connected(ch)
+	return
+}
+
+// addPending add servers handshake which wait client answer. Handshake
+// removed if client does not answer during server connect timeout. It returns
+// false if number of pending handshakes reached limit
+func (c *connect) addPending(hs *handshake) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if _, ok := c.pending[hs.uuid]; !ok && len(c.pending) >= pendingMax {
+		return false
+	}
+	c.pending[hs.uuid] = hs
+	time.AfterFunc(ServerConnectTimeout, func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.pending[hs.uuid] == hs {
+			delete(c.pending, hs.uuid)
+		}
+	})
+	return true
+}
+
+// pendingFull return true if number of servers handshakes which wait client
+// answer reached limit
+func (c *connect) pendingFull() bool {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return len(c.pending) >= pendingMax
+}
+
+// getPending get servers handshake which wait client answer
+func (c *connect) getPending(uuid string) (hs *handshake, ok bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	hs, ok = c.pending[uuid]
+	return
+}
+
+// deletePending delete servers handshake
+func (c *connect) deletePending(uuid string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.pending, uuid)
+}
@@ -0,0 +1,156 @@
+package tru
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestHandshakeKeys(t *testing.T) {
+
+	client, err := newHandshake("uuid", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newHandshake("uuid", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverIdentity, _ := GenerateIdentity()
+	clientIdentity, _ := GenerateIdentity()
+
+	// Both sides derive the same keys
+	if err = client.derive(client.public(), server.public()); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.derive(client.public(), server.public()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(client.keys.session, server.keys.session) ||
+		!bytes.Equal(client.keys.server, server.keys.server) ||
+		!bytes.Equal(client.keys.client, server.keys.client) {
+		t.Fatal("derived keys does not match")
+	}
+	if bytes.Equal(client.keys.server, client.keys.client) {
+		t.Fatal("derived keys are equal")
+	}
+
+	// Server identity
+	sealed, err := server.seal(server.keys.server, serverIdentity, "server", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.open(client.keys.server, sealed, "server", nil); err != nil {
+		t.Fatalf("can't open server identity: %s", err)
+	}
+	if !client.peerKey.Equal(serverIdentity.Public()) {
+		t.Error("wrong server identity")
+	}
+
+	// Client identity bound to server identity
+	sealed, err = client.seal(client.keys.client, clientIdentity, "client",
+		client.peerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.open(server.keys.client, sealed, "client",
+		clientIdentity.Public().(ed25519.PublicKey)); err != errHandshake {
+		t.Error("client identity bound to other server accepted")
+	}
+	if err = server.open(server.keys.client, sealed, "server",
+		serverIdentity.Public().(ed25519.PublicKey)); err != errHandshake {
+		t.Error("client identity with wrong label accepted")
+	}
+	if err = server.open(server.keys.client, sealed, "client",
+		serverIdentity.Public().(ed25519.PublicKey)); err != nil {
+		t.Fatalf("can't open client identity: %s", err)
+	}
+	if !server.peerKey.Equal(clientIdentity.Public()) {
+		t.Error("wrong client identity")
+	}
+
+	// Tampered message
+	sealed[len(sealed)/2] ^= 1
+	if err = server.open(server.keys.client, sealed, "client",
+		serverIdentity.Public().(ed25519.PublicKey)); err != errHandshake {
+		t.Error("tampered client identity accepted")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	tests := []struct {
+		server, client LegacyHandshake
+		connected      bool
+	}{
+		{false, false, true},
+		{true, false, true},
+		{true, true, true},
+		{false, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("server legacy %v client legacy %v", test.server,
+			test.client), func(t *testing.T) {
+
+			received := make(chan *Channel, 1)
+			reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+				if err == nil {
+					received <- ch
+				}
+				return
+			}
+
+			server, err := New(0, reader, test.server, log)
+			if err != nil {
+				t.Fatalf("can't start server, err: %s", err)
+			}
+			defer server.Close()
+
+			client, err := New(0, test.client, log)
+			if err != nil {
+				t.Fatalf("can't start client, err: %s", err)
+			}
+			defer client.Close()
+
+			ch, err := client.Connect(server.LocalAddr().String())
+			if !test.connected {
+				if err == nil {
+					t.Fatal("legacy handshake accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("can't connect to server, err: %s", err)
+			}
+			if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+				t.Fatalf("WriteTo err: %s", err)
+			}
+
+			var sch *Channel
+			select {
+			case sch = <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("packet not received")
+			}
+
+			// Peers know each other identities in X25519 handshake
+			if test.client {
+				return
+			}
+			if !ch.peerKey.Equal(server.identity.Public()) {
+				t.Error("wrong server identity")
+			}
+			if !sch.peerKey.Equal(client.identity.Public()) {
+				t.Error("wrong client identity")
+			}
+		})
+	}
+}
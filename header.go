@@ -0,0 +1,148 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Packet header module
+
+package tru
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	rnd "math/rand"
+)
+
+// ProtocolVersion parameter type sets max protocol version used in channels.
+// Peers negotiate lower of both versions during connect, so peers of
+// different versions works together. Zero value sets latest version.
+type ProtocolVersion int
+
+// Protocol versions
+const (
+	protocolVersion5 = 5 // Short header with status and 20 bit packet id
+	protocolVersion6 = 6 // Long header with flags, connection id and 32 bit sequence number
+
+	protocolVersion = protocolVersion6 // Latest protocol version
+)
+
+// Packet headers length
+const (
+	shortHeaderLen = 4
+	longHeaderLen  = 12
+	maxHeaderLen   = longHeaderLen
+)
+
+// ErrWrongPacketVersion returns by UnmarshalBinary when packet has header of
+// unsupported protocol version
+var ErrWrongPacketVersion = errors.New("wrong packet protocol version")
+
+// channelHeader is channels packet header parameters negotiated in handshake
+type channelHeader struct {
+	version    uint8       // Protocol version
+	connID     uint32      // Connection ID of packets received by channel
+	peerConnID uint32      // Connection ID of packets sent to peer
+	suite      CipherSuite // Packets cipher suite
+}
+
+// newConnID create new random nonzero connection ID unused by tru channels
+func (tru *Tru) newConnID() (connID uint32) {
+	tru.mu.RLock()
+	defer tru.mu.RUnlock()
+
+	for connID == 0 || tru.connIDs[connID] != nil {
+		connID = rnd.Uint32()
+	}
+	return
+}
+
+// check check protocol version parameter and return it or latest
+// version if zero
+func (v ProtocolVersion) check() (version uint8, err error) {
+	switch {
+	case v == 0:
+		version = protocolVersion
+	case v < protocolVersion5 || v > protocolVersion:
+		err = fmt.Errorf("unsupported protocol version %d", v)
+	default:
+		version = uint8(v)
+	}
+	return
+}
+
+// isHandshake return true if packet status is connect handshake status.
+// Handshake packets always have short header, so peers of any version can
+// read it.
+func isHandshake(status uint8) bool {
+	return status <= statusConnectDone
+}
+
+// longHeader return true if packet has long header
+func (p *Packet) longHeader() bool {
+	return p.version >= protocolVersion6 && !isHandshake(p.status)
+}
+
+// appendHeader append packet header to the end of b
+//
+//	Short header, version 5 packets and handshake packets:
+//	+--------------+---------------+-------------+
+//	| STATUS 8 bit | VERSION 4 bit | ID 20 bit   |
+//	+--------------+---------------+-------------+
+//	VERSION: 0 in version 5 packets
+//
+//	Long header, version 6 channel packets:
+//	+--------------+---------------+-------------+-------------+----------------------+------------+
+//	| STATUS 8 bit | VERSION 4 bit | FLAGS 8 bit | ZERO 12 bit | CONNECTION ID uint32 | SEQ uint32 |
+//	+--------------+---------------+-------------+-------------+----------------------+------------+
+func (p *Packet) appendHeader(b []byte) []byte {
+	le := binary.LittleEndian
+
+	if !p.longHeader() {
+		statid := p.packStatID()
+		if p.version >= protocolVersion6 {
+			statid |= uint32(p.version&0xF) << 20
+		}
+		return le.AppendUint32(b, statid)
+	}
+
+	b = le.AppendUint32(b, uint32(p.status)<<24|uint32(p.version&0xF)<<20|
+		uint32(p.flags)<<12)
+	b = le.AppendUint32(b, p.connID)
+	return le.AppendUint32(b, p.id)
+}
+
+// unmarshalHeader unmarshal packet header, packet data refers to input data
+func (p *Packet) unmarshalHeader(data []byte) (err error) {
+	le := binary.LittleEndian
+
+	if len(data) < shortHeaderLen {
+		return ErrWrongPacketLen
+	}
+	word := le.Uint32(data)
+	p.unpackStatID(word)
+
+	// Get version, packets from version 5 peers has zero version
+	p.version = uint8(word>>20) & 0xF
+	p.flags, p.connID = 0, 0
+	switch {
+	case p.version == 0:
+		p.version = protocolVersion5
+	case isHandshake(p.status):
+		// Handshake packets of any version has short header
+	case p.version == protocolVersion6:
+		if len(data) < longHeaderLen {
+			return ErrWrongPacketLen
+		}
+		p.flags = uint8(word >> 12)
+		p.connID = le.Uint32(data[4:])
+		p.id = le.Uint32(data[8:])
+	default:
+		return ErrWrongPacketVersion
+	}
+
+	p.data = nil
+	if len(data) > p.HeaderLen() {
+		p.data = data[p.HeaderLen():]
+	}
+	return
+}
@@ -0,0 +1,154 @@
+package tru
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestPacketHeader(t *testing.T) {
+
+	tests := []struct {
+		pac       Packet
+		headerLen int
+	}{
+		// Version 5 packets
+		{Packet{id: packetIDLimit - 1, status: statusData}, shortHeaderLen},
+		{Packet{id: 12, status: statusAck, version: protocolVersion5}, shortHeaderLen},
+		// Version 6 handshake packet
+		{Packet{status: statusConnect, version: protocolVersion6}, shortHeaderLen},
+		// Version 6 channel packets
+		{Packet{id: 0xFFFFFFFF, status: statusDataNext, version: protocolVersion6,
+			flags: 0xA5, connID: 0x12345678}, longHeaderLen},
+		{Packet{id: 1, status: statusPing, version: protocolVersion6, connID: 1},
+			longHeaderLen},
+	}
+
+	for i := range tests {
+		pac := &tests[i].pac
+		pac.data = []byte("some test data")
+		data, err := pac.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != tests[i].headerLen+len(pac.data) {
+			t.Errorf("test %d: wrong header length %d", i, len(data)-len(pac.data))
+		}
+
+		var pacout Packet
+		if err = pacout.UnmarshalBinary(data); err != nil {
+			t.Fatalf("test %d: %s", i, err)
+		}
+		version := pac.version
+		if version == 0 {
+			version = protocolVersion5
+		}
+		if pacout.id != pac.id || pacout.status != pac.status ||
+			pacout.version != version || pacout.flags != pac.flags ||
+			pacout.connID != pac.connID || !bytes.Equal(pacout.data, pac.data) {
+			t.Errorf("test %d: wrong unmarshalled packet: %d %d %d %x %x %q", i,
+				pacout.id, pacout.status, pacout.version, pacout.flags,
+				pacout.connID, pacout.data)
+		}
+	}
+
+	// Long header too short and unknown version
+	var pac Packet
+	if err := pac.UnmarshalBinary([]byte{0, 0, 0x60, statusData, 0}); err != ErrWrongPacketLen {
+		t.Errorf("wrong short long header error: %v", err)
+	}
+	if err := pac.UnmarshalBinary([]byte{0, 0, 0x70, statusData}); err != ErrWrongPacketVersion {
+		t.Errorf("wrong unknown version error: %v", err)
+	}
+
+	// Handshake packets of unknown version accepted
+	if err := pac.UnmarshalBinary([]byte{0, 0, 0x70, statusConnect}); err != nil ||
+		pac.version != 7 {
+		t.Errorf("handshake packet of unknown version not accepted: %v", err)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	const numPackets = 10
+
+	tests := []struct {
+		server, client, expected int
+	}{
+		{0, 0, protocolVersion6},
+		{protocolVersion5, 0, protocolVersion5},
+		{0, protocolVersion5, protocolVersion5},
+		{protocolVersion5, protocolVersion5, protocolVersion5},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("server v%d client v%d", test.server, test.client),
+			func(t *testing.T) {
+
+				received := make(chan *Channel, numPackets)
+				reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+					if err == nil {
+						received <- ch
+					}
+					return
+				}
+
+				// Version 5 peers use legacy handshake, server accepts it from
+				// version 5 client by default
+				legacy := LegacyHandshake(test.server == protocolVersion5 ||
+					test.client == protocolVersion5)
+				serverLegacy := LegacyHandshake(test.server == protocolVersion5)
+
+				server, err := New(0, reader, ProtocolVersion(test.server),
+					serverLegacy, log)
+				if err != nil {
+					t.Fatalf("can't start server, err: %s", err)
+				}
+				defer server.Close()
+
+				client, err := New(0, ProtocolVersion(test.client), legacy, log)
+				if err != nil {
+					t.Fatalf("can't start client, err: %s", err)
+				}
+				defer client.Close()
+
+				ch, err := client.Connect(server.LocalAddr().String())
+				if err != nil {
+					t.Fatalf("can't connect to server, err: %s", err)
+				}
+				if ch.Version() != test.expected {
+					t.Errorf("wrong client channel version %d", ch.Version())
+				}
+
+				for i := 0; i < numPackets; i++ {
+					if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+						t.Fatalf("WriteTo err: %s", err)
+					}
+				}
+				for i := 0; i < numPackets; i++ {
+					select {
+					case sch := <-received:
+						if sch.Version() != test.expected {
+							t.Fatalf("wrong server channel version %d", sch.Version())
+						}
+					case <-time.After(5 * time.Second):
+						t.Fatalf("received %d packets from %d", i, numPackets)
+					}
+				}
+			})
+	}
+
+	// Unsupported version
+	if _, err := New(0, ProtocolVersion(4), log); err == nil {
+		t.Error("unsupported protocol version accepted")
+	}
+	if _, err := New(0, ProtocolVersion(protocolVersion5), log); err == nil {
+		t.Error("protocol version 5 without legacy handshake accepted")
+	}
+}
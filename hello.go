@@ -0,0 +1,118 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Hello module
+
+package tru
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Client may send hello data to server in handshake, and server may answer
+// with reply data, so application may authenticate client without extra
+// round trip after connect. Hello data sent in client answer and reply data
+// sent in connect done packets when session key is known. They are encrypted
+// by keys derived from session key, each key encrypts one message. Hello
+// data requires protocol version 6.
+//
+// Server gets hello data in AuthorizeFunc and HelloFunc callbacks and by
+// Channel.Hello in ConnectFunc callback. In legacy handshake server channel
+// is authorized before client answer received, so hello data delivered to
+// HelloFunc and ConnectFunc only. Client gets reply data by Channel.Hello.
+
+// HelloData parameter type of Connect and ConnectContext sets hello data sent
+// to server in handshake. Hello data is not sent in first connect packet, it
+// is sent in client answer after one round trip, when session key is known,
+// so connect with hello data takes the same time as connect without it.
+// Client sending hello data does not resume session by ticket.
+type HelloData []byte
+
+// HelloFunc hello data callback function type. It is called by server when
+// client hello data received, before connect done packet sent. Returned reply
+// data sent to client in connect done packet
+type HelloFunc func(ch *Channel, hello []byte) (reply []byte)
+
+const (
+	helloMaxLen      = 1024 // Max length of hello and reply data
+	helloClientLabel = "tru hello client"
+	helloServerLabel = "tru hello server"
+)
+
+// ErrHelloTooLong returned when hello or reply data is longer than 1024 bytes
+var ErrHelloTooLong = errors.New("hello data too long")
+
+var errHelloVersion = errors.New("hello data requires protocol version 6")
+
+// sealHello encrypt hello or reply data by key derived with label from
+// session key. Connection uuid authenticated with data
+func sealHello(sessionKey []byte, label string, uuid, data []byte) (out []byte, err error) {
+	if len(data) > helloMaxLen {
+		err = ErrHelloTooLong
+		return
+	}
+	aead, err := newHelloAEAD(sessionKey, label)
+	if err != nil {
+		return
+	}
+	out = aead.Seal(nil, make([]byte, aead.NonceSize()), data, uuid)
+	return
+}
+
+// openHello decrypt hello or reply data
+func openHello(sessionKey []byte, label string, uuid, data []byte) (out []byte, err error) {
+	if len(data) == 0 {
+		return
+	}
+	aead, err := newHelloAEAD(sessionKey, label)
+	if err != nil {
+		return
+	}
+	out, err = aead.Open(nil, make([]byte, aead.NonceSize()), data, uuid)
+	if err != nil {
+		err = errHandshake
+	}
+	return
+}
+
+// newHelloAEAD derive key with label from session key and create hello data
+// cipher
+func newHelloAEAD(sessionKey []byte, label string) (aead cipher.AEAD, err error) {
+	key := make([]byte, handshakeKeyLen)
+	kdf := hkdf.New(sha256.New, sessionKey, nil, []byte(label))
+	if _, err = io.ReadFull(kdf, key); err != nil {
+		return
+	}
+	return newHandshakeAEAD(key)
+}
+
+// serveHelloData save clients hello data in channel, call hello callback and
+// return encrypted reply data. Channel destroyed if reply data too long
+func (tru *Tru) serveHelloData(ch *Channel, uuid, hello []byte) (reply []byte, err error) {
+	ch.hello = hello
+	if tru.hellocb == nil || hello == nil {
+		return
+	}
+	data := tru.hellocb(ch, hello)
+	if len(data) == 0 {
+		return
+	}
+	reply, err = sealHello(ch.sessionKey.bytes, helloServerLabel, uuid, data)
+	if err != nil {
+		ch.destroy(fmt.Sprint("channel hello reply error, destroy ", ch.Addr().String()))
+	}
+	return
+}
+
+// Hello return hello data received from peer in handshake: clients hello
+// data in server channel and servers reply data in client channel
+func (ch *Channel) Hello() []byte {
+	return ch.hello
+}
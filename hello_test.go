@@ -0,0 +1,119 @@
+package tru
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestHello(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	for _, legacy := range []LegacyHandshake{false, true} {
+		t.Run(fmt.Sprintf("legacy %v", legacy), func(t *testing.T) {
+
+			// Server accepts clients with login hello data and replies to it
+			authorized := make(chan []byte, 10)
+			authorize := func(addr net.Addr, peerKey ed25519.PublicKey,
+				hello []byte) error {
+				if peerKey != nil {
+					authorized <- hello
+				}
+				if peerKey != nil && !bytes.HasPrefix(hello, []byte("login")) {
+					return ErrUnauthorized
+				}
+				return nil
+			}
+			helloFunc := func(ch *Channel, hello []byte) []byte {
+				return append([]byte("welcome "), hello...)
+			}
+			connected := make(chan []byte, 10)
+			connectFunc := func(ch *Channel, err error) {
+				connected <- ch.Hello()
+			}
+
+			server, err := New(0, AuthorizeFunc(authorize), HelloFunc(helloFunc),
+				ConnectFunc(connectFunc), legacy, log)
+			if err != nil {
+				t.Fatalf("can't start server, err: %s", err)
+			}
+			defer server.Close()
+
+			client, err := New(0, legacy, log)
+			if err != nil {
+				t.Fatalf("can't start client, err: %s", err)
+			}
+			defer client.Close()
+			addr := server.LocalAddr().String()
+
+			// Short and long hello data
+			for _, hello := range [][]byte{
+				[]byte("login user"),
+				append([]byte("login "), bytes.Repeat([]byte{'.'}, helloMaxLen-20)...),
+			} {
+				ch, err := client.Connect(addr, HelloData(hello))
+				if err != nil {
+					t.Fatalf("can't connect to server, err: %s", err)
+				}
+				if reply := ch.Hello(); !bytes.Equal(reply, helloFunc(nil, hello)) {
+					t.Errorf("wrong reply data: %q", reply)
+				}
+				if !legacy {
+					if h := <-authorized; !bytes.Equal(h, hello) {
+						t.Errorf("wrong authorized hello data: %q", h)
+					}
+				}
+				if h := <-connected; !bytes.Equal(h, hello) {
+					t.Errorf("wrong connected hello data: %q", h)
+				}
+				ch.Close()
+			}
+
+			// Client without login hello data rejected at once
+			if !legacy {
+				start := time.Now()
+				_, err = client.Connect(addr, ConnectTimeout(5*time.Second))
+				if err != ErrUnauthorized {
+					t.Errorf("wrong rejected client error: %v", err)
+				}
+				if d := time.Since(start); d > time.Second {
+					t.Errorf("client rejected too late: %v", d)
+				}
+				n := 0
+				client.ForEachChannel(func(*Channel) { n++ })
+				if n != 0 {
+					t.Errorf("rejected client has %d channels", n)
+				}
+			}
+
+			// Too long hello data
+			_, err = client.Connect(addr, HelloData(make([]byte, helloMaxLen+1)))
+			if err != ErrHelloTooLong {
+				t.Errorf("wrong too long hello data error: %v", err)
+			}
+		})
+	}
+
+	// Hello data to protocol version 5 server
+	server, err := New(0, ProtocolVersion(protocolVersion5), LegacyHandshake(true), log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+	client, err := New(0, LegacyHandshake(true), log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+	_, err = client.Connect(server.LocalAddr().String(), HelloData("login"))
+	if err != errHelloVersion {
+		t.Errorf("wrong hello data to version 5 server error: %v", err)
+	}
+}
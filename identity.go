@@ -0,0 +1,158 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Identity module
+
+package tru
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+)
+
+// Tru identity is long term Ed25519 key. Peers prove its identities in X25519
+// handshake, so server may authorize clients by its public keys and clients
+// may pin servers public keys. Identity key generated in New if it is not set
+// by ed25519.PrivateKey parameter, use LoadIdentity to keep the same identity
+// between restarts.
+
+// AuthorizeFunc authorize peer function type. It is called in X25519
+// handshake when peers identity verified: by server before it creates channel
+// of connecting client and by client before it creates channel to server.
+// Connection rejected if function returns error, rejected X25519 handshake
+// client gets ErrUnauthorized from server at once. The peerKey is nil in legacy
+// handshake, the helloData is clients hello data sent in handshake, it is nil
+// when client authorizes server and in legacy handshake
+type AuthorizeFunc func(addr net.Addr, peerKey ed25519.PublicKey, helloData []byte) error
+
+// ErrUnauthorized returned when peer connection rejected by authorize function
+var ErrUnauthorized = errors.New("peer unauthorized")
+
+const identityPEMType = "PRIVATE KEY"
+
+// GenerateIdentity create new Ed25519 identity key
+func GenerateIdentity() (identity ed25519.PrivateKey, err error) {
+	_, identity, err = ed25519.GenerateKey(rand.Reader)
+	return
+}
+
+// MarshalIdentity marshal identity key to PKCS #8 PEM
+func MarshalIdentity(identity ed25519.PrivateKey) (data []byte, err error) {
+	der, err := x509.MarshalPKCS8PrivateKey(identity)
+	if err != nil {
+		return
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: identityPEMType, Bytes: der})
+	return
+}
+
+// ParseIdentity parse identity key from PKCS #8 PEM
+func ParseIdentity(data []byte) (identity ed25519.PrivateKey, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != identityPEMType {
+		err = errors.New("identity PEM block not found")
+		return
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return
+	}
+	identity, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		err = errors.New("identity is not Ed25519 key")
+	}
+	return
+}
+
+// LoadIdentity load identity key from PEM file. New identity key generated
+// and saved to the file if file does not exists
+func LoadIdentity(file string) (identity ed25519.PrivateKey, err error) {
+	data, err := os.ReadFile(file)
+	if err == nil {
+		return ParseIdentity(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	// Generate and save new identity
+	identity, err = GenerateIdentity()
+	if err != nil {
+		return
+	}
+	data, err = MarshalIdentity(identity)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(file, data, 0600)
+	return
+}
+
+// PublicKey return tru identity public key
+func (tru *Tru) PublicKey() ed25519.PublicKey {
+	return tru.identity.Public().(ed25519.PublicKey)
+}
+
+// PeerPublicKey return peer identity public key verified in handshake, or nil
+// if channel connected with legacy handshake
+func (ch *Channel) PeerPublicKey() ed25519.PublicKey {
+	return ch.peerKey
+}
+
+// authorize peer if authorize function set
+func (tru *Tru) authorize(addr net.Addr, peerKey ed25519.PublicKey,
+	helloData []byte) (err error) {
+
+	if tru.authorizecb == nil {
+		return
+	}
+	if err = tru.authorizecb(addr, peerKey, helloData); err != nil {
+		log.Connect.Println("peer unauthorized", addr.String(), err)
+		err = ErrUnauthorized
+	}
+	return
+}
+
+// rejectProof return servers proof of client rejection bound to connection
+// uuid. It signed by session key, so reject can't be forged
+func rejectProof(sessionKey, uuid []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("tru reject"))
+	mac.Write(uuid)
+	return mac.Sum(nil)
+}
+
+// validReject return true if connect packet has valid reject proof
+func validReject(sessionKey []byte, cp connectPacketData) bool {
+	return hmac.Equal(cp.options.reject, rejectProof(sessionKey, cp.uuid))
+}
+
+// writeReject send servers answer with reject proof to client rejected by
+// authorize function, and save it to resend to retransmitted client packets
+func (c *connect) writeReject(tru *Tru, addr net.Addr, header channelHeader,
+	status int, sessionKey []byte, cp connectPacketData) (err error) {
+
+	cp.extended = header.version >= protocolVersion6
+	cp.options.reject = rejectProof(sessionKey, cp.uuid)
+	data, err := cp.MarshalBinary()
+	if err != nil {
+		return
+	}
+	pac := tru.newPacket().SetStatus(status).SetData(data)
+	pac.version = header.version
+	data, err = pac.MarshalBinary()
+	if err != nil {
+		return
+	}
+	c.addAnswer(addr, string(cp.uuid), status, data)
+	err = tru.writeToUnvalidated(data, addr)
+	return
+}
@@ -0,0 +1,99 @@
+package tru
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestLoadIdentity(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "identity.pem")
+
+	// Identity generated and saved at first load
+	identity, err := LoadIdentity(file)
+	if err != nil {
+		t.Fatalf("can't create identity, err: %s", err)
+	}
+	loaded, err := LoadIdentity(file)
+	if err != nil {
+		t.Fatalf("can't load identity, err: %s", err)
+	}
+	if !identity.Equal(loaded) {
+		t.Error("loaded identity does not match")
+	}
+
+	if _, err = ParseIdentity([]byte("wrong pem")); err == nil {
+		t.Error("wrong identity parsed")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	serverIdentity, _ := GenerateIdentity()
+	clientIdentity, _ := GenerateIdentity()
+	otherIdentity, _ := GenerateIdentity()
+
+	// pin return authorize function which accepts peer with key only
+	pin := func(key ed25519.PrivateKey) AuthorizeFunc {
+		return func(addr net.Addr, peerKey ed25519.PublicKey, helloData []byte) error {
+			if !peerKey.Equal(key.Public()) {
+				return errors.New("unknown peer")
+			}
+			return nil
+		}
+	}
+
+	server, err := New(0, serverIdentity, pin(clientIdentity), log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+	addr := server.LocalAddr().String()
+
+	// Authorized client connects to pinned server
+	client, err := New(0, clientIdentity, pin(serverIdentity), log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+	ch, err := client.Connect(addr)
+	if err != nil {
+		t.Fatalf("can't connect to server, err: %s", err)
+	}
+	if !ch.PeerPublicKey().Equal(server.PublicKey()) {
+		t.Error("wrong server public key")
+	}
+
+	// Client with pinned other server key rejects server
+	client2, err := New(0, clientIdentity, pin(otherIdentity), log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client2.Close()
+	if _, err = client2.Connect(addr); err != ErrUnauthorized {
+		t.Errorf("server with wrong key not rejected, err: %v", err)
+	}
+
+	// Server rejects unknown client before channel created
+	client3, err := New(0, otherIdentity, log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client3.Close()
+	if _, err = client3.Connect(addr); err == nil {
+		t.Error("unknown client connected")
+	}
+	var channels int
+	server.ForEachChannel(func(*Channel) { channels++ })
+	if channels != 1 {
+		t.Errorf("wrong number of server channels %d", channels)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Anti abuse limits module
+
+package tru
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server answers to handshake packets before client address validated, and
+// tru answers to punch packets, so spoofed packets may be used to reflect
+// traffic to victim address. Server sends to unvalidated address not more
+// than amplificationFactor bytes per byte received from it. Client address
+// validated when client answered to server answer, or sent valid retry
+// cookie. Retry answer is limited by length of connect packet it answers, so
+// server keeps no state of address before retry cookie validated. Received
+// punch packets are rate limited by source ip and sent punch packets are rate
+// limited by destination ip. Number of servers handshakes which wait client
+// answer is limited, new connect packets dropped over the limit.
+
+// PunchRateLimit parameter type sets per ip rate limit of received and sent
+// punch packets: punch packets rate per second and burst. Zero values set
+// defaults, negative values switch limit off.
+type PunchRateLimit struct {
+	Rate  float64 // Punch packets per second from or to one ip
+	Burst int     // Max punch packets burst from or to one ip
+}
+
+// Default punch rate limit
+const (
+	defaultPunchRate  = 10
+	defaultPunchBurst = 20
+)
+
+const (
+	amplificationFactor = 3               // Max unvalidated sent/received ratio
+	amplificationMax    = 4096            // Max number of tracked addresses
+	rateLimitersMax     = 4096            // Max number of per ip rate limiters
+	pendingMax          = 4096            // Max number of pending server handshakes
+	limitsCleanInterval = 1 * time.Second // Expired limits state clean interval
+)
+
+// ErrPunchRateLimit returned by WriteToPunch when punch rate limit exceeded
+var ErrPunchRateLimit = errors.New("punch rate limit exceeded")
+
+var errAmplificationLimit = errors.New("amplification limit exceeded")
+var errPendingLimit = errors.New("pending handshakes limit exceeded")
+
+// LimitStatistic is numbers of packets dropped or not sent by anti abuse
+// limits
+type LimitStatistic struct {
+	Connect       int64 // Connect packets dropped by connect rate limit
+	Pending       int64 // Connect packets dropped by pending handshakes limit
+	Punch         int64 // Punch packets dropped by punch rate limit
+	PunchSend     int64 // Punch packets not sent by punch rate limit
+	Amplification int64 // Packets not sent to unvalidated address
+}
+
+// String stringlify limit statistic
+func (s LimitStatistic) String() string {
+	return fmt.Sprintf("connect: %d, pending: %d, punch: %d/%d, amplification: %d",
+		s.Connect, s.Pending, s.Punch, s.PunchSend, s.Amplification)
+}
+
+// limitCounters is anti abuse limits counters
+type limitCounters struct {
+	connect       atomic.Int64
+	pending       atomic.Int64
+	punch         atomic.Int64
+	punchSend     atomic.Int64
+	amplification atomic.Int64
+}
+
+// rateLimiters is per ip token bucket rate limiters. New ips share overflow
+// limiter when limiters map is full
+type rateLimiters struct {
+	rate     float64                 // Tokens per second, negative - no limit
+	burst    float64                 // Bucket size
+	limiters map[string]*rateLimiter // Rate limiters by ip
+	overflow rateLimiter             // Shared limiter of ips over map size
+	sync.Mutex
+}
+
+// rateLimiter is token bucket rate limiter
+type rateLimiter struct {
+	tokens float64   // Available tokens
+	time   time.Time // Last tokens update time
+}
+
+// init rate limiters, zero rate or burst set to default value
+func (r *rateLimiters) init(rate float64, burst int, defRate float64, defBurst int) {
+	if rate == 0 {
+		rate = defRate
+	}
+	if burst == 0 {
+		burst = defBurst
+	}
+	if burst < 0 {
+		rate = -1
+	}
+	r.rate, r.burst = rate, float64(burst)
+	r.limiters = make(map[string]*rateLimiter)
+	r.overflow = rateLimiter{tokens: r.burst, time: time.Now()}
+}
+
+// allow return true if packet from or to address allowed by rate limiter
+func (r *rateLimiters) allow(addr net.Addr) bool {
+	if r.rate < 0 {
+		return true
+	}
+	ip := addr.String()
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		ip = udp.IP.String()
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	l, ok := r.limiters[ip]
+	switch {
+	case ok:
+	case len(r.limiters) >= rateLimitersMax:
+		l = &r.overflow
+	default:
+		l = &rateLimiter{tokens: r.burst, time: now}
+		r.limiters[ip] = l
+	}
+	l.tokens = min(r.burst, l.tokens+now.Sub(l.time).Seconds()*r.rate)
+	l.time = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// clean remove limiters with full bucket
+func (r *rateLimiters) clean(now time.Time) {
+	if r.rate < 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	for ip, l := range r.limiters {
+		if l.tokens+now.Sub(l.time).Seconds()*r.rate >= r.burst {
+			delete(r.limiters, ip)
+		}
+	}
+}
+
+// amplification is bytes received from and sent to unvalidated addresses,
+// and validated addresses
+type amplification struct {
+	addrs     map[string]*amplificationBudget // Unvalidated addresses budgets
+	validated map[string]time.Time            // Validated addresses
+	sync.Mutex
+}
+
+// amplificationBudget is bytes received from and sent to unvalidated address
+type amplificationBudget struct {
+	recv, sent int       // Received and sent bytes
+	time       time.Time // First packet received time
+}
+
+// init amplification limit
+func (a *amplification) init() {
+	a.addrs = make(map[string]*amplificationBudget)
+	a.validated = make(map[string]time.Time)
+}
+
+// received add bytes received from unvalidated address. New address does not
+// tracked when budgets map is full, so nothing may be sent to it
+func (a *amplification) received(addr net.Addr, n int) {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, ok := a.validated[addr.String()]; ok {
+		return
+	}
+	b, ok := a.addrs[addr.String()]
+	if !ok {
+		if len(a.addrs) >= amplificationMax {
+			return
+		}
+		b = &amplificationBudget{time: time.Now()}
+		a.addrs[addr.String()] = b
+	}
+	b.recv += n
+}
+
+// allow return true and add sent bytes if n bytes may be sent to address
+func (a *amplification) allow(addr net.Addr, n int) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, ok := a.validated[addr.String()]; ok {
+		return true
+	}
+	b, ok := a.addrs[addr.String()]
+	if !ok || b.sent+n > amplificationFactor*b.recv {
+		return false
+	}
+	b.sent += n
+	return true
+}
+
+// validate move address from budgets to validated addresses. Address keeps
+// its budget when validated addresses map is full
+func (a *amplification) validate(addr net.Addr) {
+	a.Lock()
+	defer a.Unlock()
+
+	if len(a.validated) >= amplificationMax {
+		return
+	}
+	delete(a.addrs, addr.String())
+	a.validated[addr.String()] = time.Now()
+}
+
+// clean remove expired addresses budgets and validated addresses
+func (a *amplification) clean(now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	for addr, b := range a.addrs {
+		if now.Sub(b.time) > ServerConnectTimeout {
+			delete(a.addrs, addr)
+		}
+	}
+	for addr, t := range a.validated {
+		if now.Sub(t) > ServerConnectTimeout {
+			delete(a.validated, addr)
+		}
+	}
+}
+
+// cleanLimits remove idle rate limiters, expired limits state and used
+// session tickets periodically until tru closed
+func (tru *Tru) cleanLimits() {
+	ticker := time.NewTicker(limitsCleanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tru.listenStop:
+			return
+		case now := <-ticker.C:
+			tru.retry.limiter.clean(now)
+			tru.punchRecv.clean(now)
+			tru.punchSend.clean(now)
+			tru.amplification.clean(now)
+			tru.tickets.clean(now)
+		}
+	}
+}
+
+// writeToStateless write answer to unvalidated address without state if it
+// is not longer than amplification limit of received packet length
+func (tru *Tru) writeToStateless(data []byte, addr net.Addr, recv int) (err error) {
+	if len(data) > amplificationFactor*recv {
+		tru.limits.amplification.Add(1)
+		log.Debugv.Println("amplification limit, drop answer to", addr.String())
+		return errAmplificationLimit
+	}
+	_, err = tru.WriteTo(data, addr)
+	return
+}
+
+// writeToUnvalidated write data to unvalidated address if amplification
+// limit allows
+func (tru *Tru) writeToUnvalidated(data []byte, addr net.Addr) (err error) {
+	if !tru.amplification.allow(addr, len(data)) {
+		tru.limits.amplification.Add(1)
+		log.Debugv.Println("amplification limit, drop answer to", addr.String())
+		return errAmplificationLimit
+	}
+	_, err = tru.WriteTo(data, addr)
+	return
+}
+
+// LimitStatistic return numbers of packets dropped or not sent by anti abuse
+// limits
+func (tru *Tru) LimitStatistic() LimitStatistic {
+	return LimitStatistic{
+		Connect:       tru.limits.connect.Load(),
+		Pending:       tru.limits.pending.Load(),
+		Punch:         tru.limits.punch.Load(),
+		PunchSend:     tru.limits.punchSend.Load(),
+		Amplification: tru.limits.amplification.Load(),
+	}
+}
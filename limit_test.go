@@ -0,0 +1,146 @@
+package tru
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestAmplificationLimit(t *testing.T) {
+
+	var a amplification
+	a.init()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+
+	// Unknown address has no budget
+	if a.allow(addr, 1) {
+		t.Error("answer to unknown address allowed")
+	}
+
+	a.received(addr, 100)
+	if !a.allow(addr, 200) {
+		t.Error("answer under amplification limit rejected")
+	}
+	if a.allow(addr, 101) {
+		t.Error("answer over amplification limit allowed")
+	}
+	if !a.allow(addr, 100) {
+		t.Error("answer up to amplification limit rejected")
+	}
+
+	// Validated address has no limit
+	a.validate(addr)
+	if !a.allow(addr, 10000) {
+		t.Error("answer to validated address rejected")
+	}
+
+	// New addresses does not tracked when budgets map is full, validated
+	// address keeps validated
+	for i := 0; len(a.addrs) < amplificationMax; i++ {
+		a.received(&net.UDPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 1000}, 100)
+	}
+	addr2 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	a.received(addr2, 100)
+	if a.allow(addr2, 1) {
+		t.Error("answer to address over budgets map size allowed")
+	}
+	a.received(addr, 100)
+	if !a.allow(addr, 10000) {
+		t.Error("answer to validated address rejected")
+	}
+
+	// Expired budgets and validated addresses removed
+	a.clean(time.Now().Add(2 * ServerConnectTimeout))
+	if len(a.addrs) != 0 || len(a.validated) != 0 {
+		t.Error("expired addresses not removed")
+	}
+	if a.allow(addr, 1) {
+		t.Error("answer to expired validated address allowed")
+	}
+}
+
+func TestPunchRateLimit(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	punched := make(chan struct{}, 100)
+	punch := func(addr net.Addr, data []byte) { punched <- struct{}{} }
+
+	tru1, err := New(0, punch, PunchRateLimit{Rate: 0.001, Burst: 3}, log)
+	if err != nil {
+		t.Fatalf("can't start tru1, err: %s", err)
+	}
+	defer tru1.Close()
+
+	tru2, err := New(0, PunchRateLimit{Rate: 0.001, Burst: 5}, log)
+	if err != nil {
+		t.Fatalf("can't start tru2, err: %s", err)
+	}
+	defer tru2.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1),
+		Port: tru1.LocalAddr().(*net.UDPAddr).Port}
+
+	// Sent punch packets limited by sender
+	for i := 0; i < 5; i++ {
+		if _, err = tru2.WriteToPunch([]byte("punch"), addr); err != nil {
+			t.Fatalf("punch %d not sent, err: %s", i, err)
+		}
+	}
+	if _, err = tru2.WriteToPunch([]byte("punch"), addr); err != ErrPunchRateLimit {
+		t.Errorf("punch over rate limit sent, err: %v", err)
+	}
+
+	// Received punch packets limited by receiver
+	for i := 0; i < 3; i++ {
+		select {
+		case <-punched:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("punch %d not received", i)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(punched) != 0 {
+		t.Error("punch over rate limit received")
+	}
+
+	s1, s2 := tru1.LimitStatistic(), tru2.LimitStatistic()
+	if s1.Punch != 2 || s2.PunchSend != 1 {
+		t.Errorf("wrong limit statistic: %v, %v", s1, s2)
+	}
+}
+
+func TestPendingLimit(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	server, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	header := channelHeader{version: protocolVersion6}
+
+	// Connect packets with new uuids does not create handshakes over limit
+	hs, _ := newHandshake("uuid", false)
+	for i := 0; i < pendingMax+100; i++ {
+		cp := connectPacketData{uuid: []byte(fmt.Sprint("uuid-", i)),
+			data: hs.public(), extended: true}
+		cp.options.handshake = handshakeX25519
+		server.connect.serveHello(server, addr, cp, header)
+	}
+	server.connect.m.RLock()
+	n := len(server.connect.pending)
+	server.connect.m.RUnlock()
+	if n > pendingMax {
+		t.Errorf("pending handshakes %d over limit %d", n, pendingMax)
+	}
+	if s := server.LimitStatistic(); s.Pending != 100 {
+		t.Errorf("wrong pending limit statistic: %d", s.Pending)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Connection migration module
+
+package tru
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packets with connection id received from new peer address does not change
+// channels address at once. Channel sends path challenge with random token to
+// the new address and peer answers with path response signed by channels
+// session key. Channel address changed to the new address when valid path
+// response received, so packets with spoofed source address can't move
+// channel. Only path packets and authenticated data packets accepted from new
+// address before it validated, other packets are not authenticated and
+// dropped. Connection migration works in protocol version 6 and later
+// channels.
+
+const (
+	pathTokenLen          = 16                     // Path challenge token length
+	pathChallengeInterval = 250 * time.Millisecond // Min interval between path challenges
+)
+
+// pathValidation is channels new path validation data
+type pathValidation struct {
+	addr  net.Addr  // New peer address
+	token []byte    // Path challenge token
+	time  time.Time // Path challenge send time
+	sync.Mutex
+}
+
+// servePath process path validation packets and start new path validation
+// when packet received from other than channels address. It returns true if
+// packet processed
+func (ch *Channel) servePath(addr net.Addr, pac *Packet) (processed bool) {
+	switch pac.Status() {
+
+	// Peer validates our new address. Peer sends challenge from its current
+	// address, challenges from other addresses are ignored so channel does
+	// not sign tokens for anyone
+	case statusPathChallenge:
+		if addr.String() == ch.Addr().String() {
+			ch.writeToPath(addr, statusPathResponse, ch.pathMAC(pac.Data()))
+		}
+		return true
+
+	// Peer answered to our path challenge
+	case statusPathResponse:
+		ch.pathValidate(addr, pac.Data())
+		return true
+	}
+
+	// Data packets received from new address processed as usual and start
+	// path validation when authenticated, channel continue sending to
+	// current address while new path is not validated. Other packets from
+	// new address dropped
+	switch {
+	case addr.String() == ch.Addr().String():
+	case pac.Status() == statusData || pac.Status() == statusDataNext:
+	default:
+		log.Debugv.Println("drop packet from not validated address", addr.String())
+		return true
+	}
+	return
+}
+
+// pathChallenge send path challenge to new peer address
+func (ch *Channel) pathChallenge(addr net.Addr) {
+	p := &ch.path
+	p.Lock()
+	defer p.Unlock()
+
+	if p.addr != nil && p.addr.String() == addr.String() &&
+		time.Since(p.time) < pathChallengeInterval {
+		return
+	}
+
+	token := make([]byte, pathTokenLen)
+	if _, err := rand.Read(token); err != nil {
+		return
+	}
+	p.addr, p.token, p.time = addr, token, time.Now()
+
+	log.Debugv.Println("send path challenge", addr.String())
+	ch.writeToPath(addr, statusPathChallenge, token)
+}
+
+// pathValidate check path response and change channels address to the new
+// address if response is valid
+func (ch *Channel) pathValidate(addr net.Addr, mac []byte) {
+	p := &ch.path
+	p.Lock()
+	valid := p.addr != nil && p.addr.String() == addr.String() &&
+		hmac.Equal(mac, ch.pathMAC(p.token))
+	if valid {
+		p.addr, p.token = nil, nil
+	}
+	p.Unlock()
+
+	if !valid {
+		log.Debugv.Println("got wrong path response from", addr.String())
+		return
+	}
+	ch.tru.rebind(ch, addr)
+}
+
+// pathMAC return path challenge token signed by channels session key
+func (ch *Channel) pathMAC(token []byte) []byte {
+	mac := hmac.New(sha256.New, ch.sessionKey.bytes)
+	mac.Write([]byte("tru path"))
+	mac.Write(token)
+	return mac.Sum(nil)
+}
+
+// writeToPath write path validation packet to address
+func (ch *Channel) writeToPath(addr net.Addr, status int, data []byte) {
+	pac, err := ch.newPacket().SetStatus(status).SetData(data).MarshalBinary()
+	if err != nil {
+		return
+	}
+	ch.tru.WriteTo(pac, addr)
+}
+
+// rebind change channels address
+func (tru *Tru) rebind(ch *Channel, addr net.Addr) {
+	tru.mu.Lock()
+	old := ch.Addr()
+	if tru.channels[old.String()] == ch {
+		delete(tru.channels, old.String())
+	}
+	tru.channels[addr.String()] = ch
+	ch.addr.Store(addr)
+	tru.mu.Unlock()
+
+	msg := fmt.Sprint("channel migrated ", old.String(), " -> ", addr.String())
+	log.Connect.Println(msg)
+	tru.statMsgs.add(msg)
+}
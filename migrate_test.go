@@ -0,0 +1,186 @@
+package tru
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+// udpProxy forwards udp packets between client and server. Proxy socket
+// connected to server may be changed to simulate client address change
+type udpProxy struct {
+	conn   net.PacketConn // Socket client connects to
+	server net.Addr       // Server address
+	client net.Addr       // Client address
+	out    net.PacketConn // Socket connected to server
+	sync.Mutex
+}
+
+// newUDPProxy create udp proxy to server
+func newUDPProxy(t *testing.T, server net.Addr) *udpProxy {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &udpProxy{conn: conn, server: server}
+	p.rebind(t)
+
+	go func() {
+		buf := make([]byte, readBufferLen)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			p.Lock()
+			p.client = addr
+			out := p.out
+			p.Unlock()
+			out.WriteTo(buf[:n], p.server)
+		}
+	}()
+	return p
+}
+
+// rebind change proxy socket connected to server, previous socket closed
+func (p *udpProxy) rebind(t *testing.T) {
+	out, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+	if p.out != nil {
+		p.out.Close()
+	}
+	p.out = out
+	p.Unlock()
+
+	go func() {
+		buf := make([]byte, readBufferLen)
+		for {
+			n, _, err := out.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			p.Lock()
+			client := p.client
+			p.Unlock()
+			p.conn.WriteTo(buf[:n], client)
+		}
+	}()
+}
+
+// close proxy sockets
+func (p *udpProxy) close() {
+	p.Lock()
+	defer p.Unlock()
+	p.conn.Close()
+	p.out.Close()
+}
+
+// outAddr return proxy address connected to server
+func (p *udpProxy) outAddr() string {
+	p.Lock()
+	defer p.Unlock()
+	return p.out.LocalAddr().String()
+}
+
+func TestConnectionMigration(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	const numPackets = 50
+	received := make(chan *Channel, 2*numPackets)
+	reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+		if err == nil {
+			received <- ch
+		}
+		return
+	}
+
+	tru1, err := New(0, reader, log)
+	if err != nil {
+		t.Fatalf("can't start tru1, err: %s", err)
+	}
+	defer tru1.Close()
+
+	tru2, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start tru2, err: %s", err)
+	}
+	defer tru2.Close()
+
+	server, _ := net.ResolveUDPAddr("udp", tru1.LocalAddr().String())
+	server.IP = net.IPv4(127, 0, 0, 1)
+	proxy := newUDPProxy(t, server)
+	defer proxy.close()
+
+	ch, err := tru2.Connect(proxy.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("can't connect to tru1, err: %s", err)
+	}
+
+	// Send packets, change client address and send packets again
+	var sch *Channel
+	send := func() {
+		for i := 0; i < numPackets; i++ {
+			if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+				t.Fatalf("WriteTo err: %s", err)
+			}
+		}
+		for i := 0; i < numPackets; i++ {
+			select {
+			case c := <-received:
+				if sch == nil {
+					sch = c
+				}
+				if c != sch {
+					t.Fatal("packet received by other channel")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("received %d packets from %d", i, numPackets)
+			}
+		}
+	}
+	send()
+	oldAddr := sch.Addr().String()
+	proxy.rebind(t)
+	send()
+
+	// Server channel migrated to new client address
+	for i := 0; sch.Addr().String() != proxy.outAddr(); i++ {
+		if i == 100 {
+			t.Fatalf("channel does not migrated from %s to %s", oldAddr,
+				proxy.outAddr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ch, ok := tru1.getChannel(proxy.outAddr()); !ok || ch != sch {
+		t.Error("migrated channel not found by new address")
+	}
+	if _, ok := tru1.getChannel(oldAddr); ok {
+		t.Error("migrated channel found by old address")
+	}
+
+	// Not authenticated packets from new address dropped before it validated
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, status := range []int{statusPing, statusAck, statusDisconnect} {
+		data, _ := ch.newPacket().SetStatus(status).MarshalBinary()
+		conn.WriteTo(data, server)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if sch.Addr().String() != proxy.outAddr() {
+		t.Error("channel migrated by not authenticated packet")
+	}
+	if _, ok := tru1.getChannel(proxy.outAddr()); !ok {
+		t.Error("channel destroyed by disconnect from not validated address")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Packets pacing module
+
+package tru
+
+import (
+	"sync"
+	"time"
+)
+
+// Data packets of channel with pacing congestion controller wait its send
+// time in channels pacing queue. One timer per channel drains the queue: it
+// sends all packets which send time came and restarts to the next packet
+// send time. Packets does not overtake each other while queue is not empty.
+
+// pacer is channels queue of paced data packets
+type pacer struct {
+	queue []pacedPacket // Packets waiting send time, sorted by send time
+	timer *time.Timer   // Queue drain timer, nil when queue is empty
+	sync.Mutex
+}
+
+// pacedPacket is marshalled data packet waiting send time
+type pacedPacket struct {
+	data []byte    // Marshalled packet
+	bufp *[]byte   // Pooled buffer of marshalled packet
+	time time.Time // Send time
+}
+
+// pace add marshalled data packet to channels pacing queue if its send time
+// does not came or queue is not empty. It returns false if packet may be
+// sent now
+func (ch *Channel) pace(pac *Packet, t time.Time, data []byte, bufp *[]byte) bool {
+	p := &ch.pacer
+	p.Lock()
+	defer p.Unlock()
+
+	delay := time.Until(t)
+	if delay <= 0 && len(p.queue) == 0 {
+		return false
+	}
+	if delay > 0 {
+		pac.shiftTime(delay)
+		ch.tru.retransmit.schedule(ch, pac)
+	}
+	p.queue = append(p.queue, pacedPacket{data, bufp, t})
+	if p.timer == nil {
+		p.timer = time.AfterFunc(delay, ch.paceFlush)
+	}
+	return true
+}
+
+// paceFlush send packets which send time came and restart timer to the next
+// packet send time
+func (ch *Channel) paceFlush() {
+	p := &ch.pacer
+	p.Lock()
+	defer p.Unlock()
+
+	if p.timer == nil {
+		return
+	}
+	now := time.Now()
+	addr := ch.Addr()
+	n := 0
+	for ; n < len(p.queue) && !p.queue[n].time.After(now); n++ {
+		ch.tru.WriteTo(p.queue[n].data, addr)
+		putBuffer(p.queue[n].bufp)
+		p.queue[n] = pacedPacket{}
+	}
+	p.queue = p.queue[n:]
+	if len(p.queue) == 0 {
+		p.queue = nil
+		p.timer = nil
+		return
+	}
+	p.timer.Reset(time.Until(p.queue[0].time))
+}
+
+// pacerDestroy stop pacing timer and free queued packets
+func (ch *Channel) pacerDestroy() {
+	p := &ch.pacer
+	p.Lock()
+	defer p.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	for i := range p.queue {
+		putBuffer(p.queue[i].bufp)
+	}
+	p.queue = nil
+}
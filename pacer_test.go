@@ -0,0 +1,91 @@
+package tru
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+// testPacer is congestion controller which paces packets with fixed interval
+type testPacer struct {
+	CongestionController
+	interval time.Duration
+	next     time.Time
+	sync.Mutex
+}
+
+// NextSendTime reserves send time of packet
+func (p *testPacer) NextSendTime(bytes int) (t time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	t = time.Now()
+	if p.next.After(t) {
+		t = p.next
+	}
+	p.next = t.Add(p.interval)
+	return
+}
+
+func TestPacer(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	const numPackets = 50
+	received := make(chan uint32, numPackets)
+	reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+		if err == nil {
+			received <- binary.LittleEndian.Uint32(pac.Data())
+		}
+		return
+	}
+	server, err := New(0, reader, log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+
+	pacer := func() CongestionController {
+		return &testPacer{CongestionController: NewRenoCongestion(),
+			interval: time.Millisecond}
+	}
+	client, err := New(0, CongestionControl(pacer), log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+
+	ch, err := client.Connect(server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("can't connect to server, err: %s", err)
+	}
+
+	// Paced packets sent in order by one timer
+	start := time.Now()
+	for i := uint32(0); i < numPackets; i++ {
+		if _, err = ch.WriteTo(binary.LittleEndian.AppendUint32(nil, i)); err != nil {
+			t.Fatalf("WriteTo err: %s", err)
+		}
+	}
+	for i := uint32(0); i < numPackets; i++ {
+		select {
+		case n := <-received:
+			if n != i {
+				t.Fatalf("wrong packet order: %d, expected %d", n, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d packets from %d", i, numPackets)
+		}
+	}
+	if d := time.Since(start); d < (numPackets-1)*time.Millisecond {
+		t.Errorf("packets does not paced: %v", d)
+	}
+	ch.pacer.Lock()
+	if len(ch.pacer.queue) != 0 || ch.pacer.timer != nil {
+		t.Error("pacing queue does not drained")
+	}
+	ch.pacer.Unlock()
+}
@@ -7,10 +7,9 @@
 package tru
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +25,8 @@ const (
 	statusPong
 	statusDisconnect
 	statusPunch
+	statusPathChallenge
+	statusPathResponse
 	statusSplit    = 0x80
 	statusDataNext = statusData + statusSplit
 )
@@ -38,17 +39,26 @@ const (
 const packetIDLimit = 0x100000          // Number of packets id (max number + 1)
 const DeliveryTimeout = 5 * time.Second // Default delivery function timeout
 
+// ErrWrongPacketLen returns by UnmarshalBinary when data shorter than header
+var ErrWrongPacketLen = errors.New("wrong packet length")
+
 // Packet struct
 type Packet struct {
 	id                 uint32             // Packet ID
 	status             uint8              // Packet Type
+	version            uint8              // Packet header protocol version
+	flags              uint8              // Packet header flags
+	connID             uint32             // Packet header connection ID
 	data               []byte             // Packet Data
+	buf                *[]byte            // Pooled data buffer, returned to pool by Release
 	time               time.Time          // Packet creating time
 	retransmitTime     time.Time          // Packet retransmit time
 	retransmitAttempts int                // Packet retransmit attempts
+	dupAcks            int                // Acks received after packet sent, send queue lock
 	delivery           PacketDeliveryFunc // Packet delivery callback function
 	deliveryTimeout    time.Duration      // Packet delivery callback timeout
-	deliveryTimer      time.Timer         // Packet delivery timeout timer
+	deliveryTimer      *time.Timer        // Packet delivery timeout timer
+	deliveryDone       atomic.Bool        // Delivery callback executed
 	sync.RWMutex
 }
 
@@ -61,51 +71,69 @@ func (tru *Tru) newPacket() *Packet {
 	return &Packet{time: time.Now()}
 }
 
+// newPacket create new empty packet with channels header parameters
+func (ch *Channel) newPacket() *Packet {
+	pac := ch.tru.newPacket()
+	pac.version = ch.header.version
+	pac.connID = ch.header.peerConnID
+	return pac
+}
+
 // MarshalBinary marshal packet
 //
 //	Bynary packet structure:
-//	+--------------------+------+
-//	| ID & STATUS uint32 | DATA |
-//	+--------------------+------+
-//	ID & STATUS uint32: STATUS 1 byte | ID 3 byte
+//	+--------+------+
+//	| HEADER | DATA |
+//	+--------+------+
+//	HEADER: short or long header depending of protocol version, see
+//	appendHeader
 func (p *Packet) MarshalBinary() (out []byte, err error) {
-	buf := new(bytes.Buffer)
-	le := binary.LittleEndian
-
-	// Pack status & id
-	statid := p.packStatID()
-
-	// Write status&id and data to buffer
-	binary.Write(buf, le, statid)
-	binary.Write(buf, le, p.data)
+	return p.AppendBinary(make([]byte, 0, p.Len()))
+}
 
-	out = buf.Bytes()
+// AppendBinary append marshalled packet to the end of b and return the
+// extended buffer. It does not allocate when b has enough capacity.
+func (p *Packet) AppendBinary(b []byte) (out []byte, err error) {
+	out = p.appendHeader(b)
+	out = append(out, p.data...)
 	return
 }
 
-// UnmarshalBinary unmarshal packet
+// UnmarshalBinary unmarshal packet. Packet data copied to pooled buffer which
+// may be returned to pool by Release.
 func (p *Packet) UnmarshalBinary(data []byte) (err error) {
-
-	buf := bytes.NewReader(data)
-	le := binary.LittleEndian
-
-	// Read status&id from buffer and unpack it to p.status and p.id
-	var statid uint32
-	err = binary.Read(buf, le, &statid)
-	if err != nil {
+	if err = p.unmarshalHeader(data); err != nil {
 		return
 	}
-	p.unpackStatID(statid)
-
-	// Read data from buffer
-	if l := buf.Len(); l > 0 {
-		p.data = make([]byte, l)
-		err = binary.Read(buf, le, &p.data)
+	if len(p.data) > 0 {
+		p.setBuffer(p.data)
 	}
-
 	return
 }
 
+// setBuffer copy data to pooled buffer and set it to packet data
+func (p *Packet) setBuffer(data []byte) {
+	buf := getBuffer(len(data))
+	p.data = append((*buf)[:0], data...)
+	p.buf = buf
+}
+
+// Release return packet data buffer to pool. Received packets delivered to
+// reader are owned by reader, which may release packet when packet data does
+// not used any more. Packet data must not be used after Release. Packets
+// which does not released collected by garbage collector.
+func (p *Packet) Release() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.buf == nil {
+		return
+	}
+	putBuffer(p.buf)
+	p.buf = nil
+	p.data = nil
+}
+
 // packStatID pack status and id from packet
 func (p *Packet) packStatID() uint32 {
 	return p.id&(packetIDLimit-1) | uint32(p.status)<<24
@@ -119,15 +147,23 @@ func (p *Packet) unpackStatID(statid uint32) {
 
 // HeaderLen get header length
 func (p *Packet) HeaderLen() int {
-	// Tru header:
-	// id 		- 3 byte
+	// Tru short header:
+	// id 		- 20 bit
+	// version	- 4 bit
 	// status	- 1 byte
-	return 4
+	if !p.longHeader() {
+		return shortHeaderLen
+	}
+	// Tru long header:
+	// status, version, flags	- 4 byte
+	// connection id		- 4 byte
+	// sequence number		- 4 byte
+	return longHeaderLen
 }
 
-// Len get packet length
+// MaxDataLen get max packet data length
 func (p *Packet) MaxDataLen() int {
-	return maxUdpDataLength - p.HeaderLen() - cryptAesLength
+	return maxUdpDataLength - maxHeaderLen - cryptAesLength
 	// return 1024 // look like optimal packet data length
 }
 
@@ -182,8 +218,11 @@ func (p *Packet) SetDelivery(delivery PacketDeliveryFunc) *Packet {
 	}
 	log.Debugvvv.Println("set delivery func, id", p.ID())
 	p.delivery = delivery
-	p.deliveryTimer = *time.AfterFunc(p.deliveryTimeout, func() {
-		// log.Error.Println("delivery timeout, id", p.ID())
+	p.deliveryTimer = time.AfterFunc(p.deliveryTimeout, func() {
+		// Delivery callback executed once, by ack or by timeout
+		if !p.deliveryDone.CompareAndSwap(false, true) {
+			return
+		}
 		err := errors.New("delivery timeout")
 		p.delivery(p, err)
 	})
@@ -199,23 +238,10 @@ func (p *Packet) SetDeliveryTimeout(timeout time.Duration) *Packet {
 
 // distance check received packet distance and return integer value
 // lesse than zero than 'id < expectedID' or return integer value more than
-// zero than 'id > tcd.expectedID'
+// zero than 'id > tcd.expectedID'. It uses protocol version 5 sequence space,
+// channels use its own sequence space
 func (p *Packet) distance(expectedID uint32, id uint32) int {
-	if expectedID == id {
-		return 0
-	}
-
-	// modSubU module of subtraction
-	modSubU := func(arga, argb uint32, mod uint64) int {
-		sub := (uint64(arga) % mod) + mod - (uint64(argb) % mod)
-		return int(sub % mod)
-	}
-
-	diff := modSubU(id, expectedID, packetIDLimit)
-	if diff < packetIDLimit/2 {
-		return int(diff)
-	}
-	return int(diff - packetIDLimit)
+	return seqSpace20.distance(expectedID, id)
 }
 
 // getRetransmitAttempts return retransmit attempts value. This function
@@ -244,6 +270,24 @@ func (p *Packet) getRetransmitTime() (rtt time.Time) {
 	return p.retransmitTime
 }
 
+// getTime get packet creating (or last sending) time
+func (p *Packet) getTime() time.Time {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.time
+}
+
+// shiftTime shift packet sending time and retransmit time when packet send
+// delayed by pacer
+func (p *Packet) shiftTime(delay time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.time = p.time.Add(delay)
+	p.retransmitTime = p.retransmitTime.Add(delay)
+}
+
 // setRetransmitTime set retransmit time to packet
 func (p *Packet) setRetransmitTime(rtt time.Duration) {
 	p.Lock()
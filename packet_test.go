@@ -1,6 +1,7 @@
 package tru
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/teonet-go/tru/teolog"
@@ -72,3 +73,67 @@ func TestPacStatusID(t *testing.T) {
 	pacUnpac(&Packet{id: 48, status: 11})
 	pacUnpac(&Packet{id: maxid, status: 255})
 }
+
+func TestPacketAppendBinary(t *testing.T) {
+
+	pac := &Packet{id: 1234, status: statusDataNext, data: []byte("some test data")}
+
+	// Append to buffer prefix and unmarshal
+	buf := make([]byte, 0, 2*1024)
+	out, err := pac.AppendBinary(append(buf, "prefix"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out[:6]) != "prefix" || len(out) != 6+pac.Len() {
+		t.Fatalf("wrong appended packet: %q", out)
+	}
+	var pacout Packet
+	if err = pacout.UnmarshalBinary(out[6:]); err != nil {
+		t.Fatal(err)
+	}
+	if pacout.id != pac.id || pacout.status != pac.status ||
+		!bytes.Equal(pacout.data, pac.data) {
+		t.Fatalf("wrong unmarshalled packet: %d %d %q", pacout.id, pacout.status, pacout.data)
+	}
+
+	// Unmarshalled packet data does not refer to input data and released to
+	// pool
+	out[6+pac.HeaderLen()] = 0
+	if pacout.data[0] != 's' {
+		t.Error("unmarshalled packet data refers to input data")
+	}
+	pacout.Release()
+	pacout.Release()
+	if pacout.Data() != nil || pacout.buf != nil {
+		t.Error("packet does not released")
+	}
+
+	// Short packets
+	if err = pacout.UnmarshalBinary(out[6:9]); err != ErrWrongPacketLen {
+		t.Errorf("wrong short packet error: %v", err)
+	}
+
+	// Append to buffer with enough capacity does not allocate
+	allocs := testing.AllocsPerRun(100, func() { pac.AppendBinary(buf[:0]) })
+	if allocs != 0 {
+		t.Errorf("AppendBinary allocates %v times", allocs)
+	}
+}
+
+func BenchmarkPacketMarshalBinary(b *testing.B) {
+	pac := &Packet{id: 1234, status: statusData, data: make([]byte, 1200)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pac.MarshalBinary()
+	}
+}
+
+func BenchmarkPacketAppendBinary(b *testing.B) {
+	pac := &Packet{id: 1234, status: statusData, data: make([]byte, 1200)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bufp := getBuffer(pac.Len())
+		pac.AppendBinary((*bufp)[:0])
+		putBuffer(bufp)
+	}
+}
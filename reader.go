@@ -0,0 +1,101 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Channel reader module
+
+package tru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// SharedReader parameter type sets one reader goroutine for all channels. By
+// default each channel has its own reader goroutine, so slow reader of one
+// channel does not stall receiving in other channels.
+type SharedReader bool
+
+// channelReader is channels received packets queue processed by channels
+// reader goroutine. The queue size limited by receive window advertised to
+// peer.
+type channelReader struct {
+	queue  list.List     // Received packets queue
+	signal chan struct{} // Packet added to queue signal
+	stop   chan struct{} // Stop reader goroutine channel
+	sync.Mutex
+}
+
+// readerInit start channels reader goroutine
+func (ch *Channel) readerInit() {
+	if ch.tru.sharedReader {
+		return
+	}
+	ch.readerQueue.signal = make(chan struct{}, 1)
+	ch.readerQueue.stop = make(chan struct{})
+	go ch.readerProccess()
+}
+
+// readerDestroy stop channels reader goroutine
+func (ch *Channel) readerDestroy() {
+	if ch.tru.sharedReader {
+		return
+	}
+	r := &ch.readerQueue
+	r.Lock()
+	defer r.Unlock()
+
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	for e := r.queue.Front(); e != nil; e = e.Next() {
+		e.Value.(*Packet).Release()
+	}
+	r.queue.Init()
+}
+
+// toReader send received packet to channels or shared reader goroutine
+func (ch *Channel) toReader(pac *Packet) {
+	ch.readerBacklog.Add(1)
+	if ch.tru.sharedReader {
+		ch.tru.readerCh <- readerChData{ch, pac, nil}
+		return
+	}
+
+	r := &ch.readerQueue
+	r.Lock()
+	r.queue.PushBack(pac)
+	r.Unlock()
+
+	select {
+	case r.signal <- struct{}{}:
+	default:
+	}
+}
+
+// readerProccess process channels received packets
+func (ch *Channel) readerProccess() {
+	r := &ch.readerQueue
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.signal:
+		}
+
+		for {
+			r.Lock()
+			e := r.queue.Front()
+			if e == nil {
+				r.Unlock()
+				break
+			}
+			r.queue.Remove(e)
+			r.Unlock()
+
+			ch.tru.processReader(readerChData{ch, e.Value.(*Packet), nil})
+		}
+	}
+}
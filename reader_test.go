@@ -0,0 +1,85 @@
+package tru
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestChannelReader(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	// Reader of channel A blocks, reader of channel B counts packets
+	const numPackets = 100
+	var portA atomic.Int32
+	block := make(chan interface{})
+	blocked := make(chan interface{})
+	received := make(chan interface{}, numPackets)
+	reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+		if err != nil {
+			return
+		}
+		if ch.Port() == int(portA.Load()) {
+			select {
+			case <-blocked:
+			default:
+				close(blocked)
+			}
+			<-block
+			return
+		}
+		received <- nil
+		return
+	}
+
+	tru1, err := New(0, reader, log)
+	if err != nil {
+		t.Fatalf("can't start tru1, err: %s", err)
+	}
+	defer tru1.Close()
+	defer close(block)
+	tru1Addr := tru1.LocalAddr().String()
+
+	// Connect peers A and B
+	connect := func() (*Tru, *Channel) {
+		tru, err := New(0, log)
+		if err != nil {
+			t.Fatalf("can't start tru, err: %s", err)
+		}
+		ch, err := tru.Connect(tru1Addr)
+		if err != nil {
+			t.Fatalf("can't connect to tru1, err: %s", err)
+		}
+		return tru, ch
+	}
+	truA, chA := connect()
+	defer truA.Close()
+	truB, chB := connect()
+	defer truB.Close()
+	portA.Store(int32(truA.LocalPort()))
+
+	// Block reader of channel A
+	chA.WriteTo([]byte("block"))
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatalf("channel A packet not received")
+	}
+
+	// Channel B packets received while channel A reader blocked
+	for i := 0; i < numPackets; i++ {
+		chA.WriteTo([]byte("data to blocked reader"))
+		chB.WriteTo([]byte("data"))
+	}
+	for i := 0; i < numPackets; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("channel B received %d packets from %d", i, numPackets)
+		}
+	}
+}
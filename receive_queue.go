@@ -10,12 +10,16 @@ import "sync"
 
 type receiveQueue struct {
 	ma           map[uint32]*Packet // Receive queue map
+	seq          seqSpace           // Packet ID sequence space
 	sync.RWMutex                    // Receive queue mutex
 }
 
 // init receive queue
 func (r *receiveQueue) init(ch *Channel) {
 	r.ma = make(map[uint32]*Packet)
+	if ch != nil {
+		r.seq = ch.seq
+	}
 }
 
 // add packet to receive queue
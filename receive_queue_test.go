@@ -64,9 +64,16 @@ func TestReceiveQueue(t *testing.T) {
 		return
 	}
 
-	// Test recive queue with serve func
+	// Test recive queue with serve func. Packets sealed by server key
+	peer, err := newPacketAEAD(ch.sessionKey.bytes, ch.header.suite, true)
+	if err != nil {
+		t.Fatal(err)
+	}
 	serve := func(id int) {
-		data, _ := tru2.newPacket().SetStatus(statusData).SetID(id).MarshalBinary()
+		pac := ch.newPacket().SetStatus(statusData).SetID(id)
+		pac.connID = ch.header.connID
+		pac.SetData(peer.seal(nil, pac.appendHeader(nil), nil, uint32(id), 0))
+		data, _ := pac.MarshalBinary()
 		tru2.serve(0, ch.Addr(), data)
 	}
 	ch.expectedID = 0
@@ -100,6 +107,19 @@ func TestReceiveQueue(t *testing.T) {
 		t.Errorf("wrong drop(2), drop = %d", ch.stat.drop)
 		return
 	}
+	if ch.stat.duplicate != 4 {
+		t.Errorf("wrong duplicate, duplicate = %d", ch.stat.duplicate)
+		return
+	}
+
+	// Forged packet dropped
+	pac := ch.newPacket().SetStatus(statusData).SetID(5).SetData([]byte("forged"))
+	pac.connID = ch.header.connID
+	data, _ := pac.MarshalBinary()
+	tru2.serve(0, ch.Addr(), data)
+	if ch.stat.forged != 1 || ch.expectedID != 5 {
+		t.Errorf("forged packet accepted, forged = %d", ch.stat.forged)
+	}
 	if ch.expectedID != 5 {
 		t.Errorf("wrong expectedID(2), expectedID = %d", ch.expectedID)
 		return
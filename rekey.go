@@ -0,0 +1,208 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Keys update module
+
+package tru
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Protocol version 6 channels update packet keys after rekey policy budget
+// of sealed packets, bytes or keys live time exhausted, or by Channel.Rekey
+// call. Next keys generation secret derived from current secret, packets
+// sealed with new keys has flipped key phase flag in long header. Peer
+// detects new key phase, checks packet by next keys and updates its keys
+// too. Packets sealed with previous keys and received during keys update
+// opened by previous receive key. Next keys update may start when previous
+// update completed: first packet sealed with current keys and all packets
+// before it acknowledged, all peer packets sealed with previous keys
+// received, and three retransmission timeouts passed since update.
+
+const (
+	flagKeyPhase = 0x01             // Long header key phase flag
+	rekeyLabel   = "tru key update" // Next generation secret label
+)
+
+// RekeyPolicy parameter type sets channels automatic keys update budget: max
+// number of packets and data bytes sealed by one key and max key live time.
+// Zero values set defaults, negative values switch limit off.
+type RekeyPolicy struct {
+	Packets  int64         // Max number of packets sealed by one key
+	Bytes    int64         // Max data bytes sealed by one key
+	Interval time.Duration // Max key live time
+}
+
+// Default rekey policy
+const (
+	defaultRekeyPackets  = 1 << 24
+	defaultRekeyBytes    = 1 << 34
+	defaultRekeyInterval = time.Hour
+)
+
+var (
+	ErrRekeyInProgress   = errors.New("channel keys update in progress")
+	ErrRekeyNotSupported = errors.New("channel does not support keys update")
+)
+
+// rekeyState is packet keys update state
+type rekeyState struct {
+	generation uint64    // Current keys generation, key phase is its low bit
+	recvFirst  uint64    // Lowest packet number received by current keys
+	sendFirst  uint64    // Lowest packet number sealed by current keys
+	sent       bool      // Packets sealed by current keys
+	packets    int64     // Number of packets sealed by current keys
+	bytes      int64     // Data bytes sealed by current keys
+	time       time.Time // Current keys start time
+}
+
+// phase return current key phase
+func (a *packetAEAD) phase() uint8 {
+	return uint8(a.rekey.generation & flagKeyPhase)
+}
+
+// sealed count packet sealed by current keys
+func (a *packetAEAD) sealed(pn uint64, bytes int) {
+	r := &a.rekey
+	if !r.sent || pn < r.sendFirst {
+		r.sendFirst, r.sent = pn, true
+	}
+	r.packets++
+	r.bytes += int64(bytes)
+}
+
+// nextKeys return next generation keys
+func (a *packetAEAD) nextKeys() (next *packetKeys, err error) {
+	if a.next != nil {
+		return a.next, nil
+	}
+	secret := make([]byte, packetKeyLen)
+	kdf := hkdf.Expand(sha256.New, a.keys.secret, []byte(rekeyLabel))
+	if _, err = io.ReadFull(kdf, secret); err != nil {
+		return
+	}
+	a.next, err = a.newPacketKeys(secret)
+	return a.next, err
+}
+
+// update switch packet keys to next generation
+func (a *packetAEAD) update() {
+	a.prev, a.keys, a.next = a.keys.recv, a.next, nil
+	a.rekey = rekeyState{generation: a.rekey.generation + 1, time: time.Now()}
+}
+
+// initiate start keys update. Peer continue sending by previous keys until
+// receive packet sealed by new keys
+func (a *packetAEAD) initiate() (err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, err = a.nextKeys(); err != nil {
+		return
+	}
+	a.update()
+	a.rekey.recvFirst = math.MaxUint64
+	return
+}
+
+// state return copy of keys update state
+func (a *packetAEAD) state() rekeyState {
+	a.Lock()
+	defer a.Unlock()
+	return a.rekey
+}
+
+// exhausted return true if current keys budget of rekey policy exhausted
+func (a *packetAEAD) exhausted(policy RekeyPolicy) bool {
+	limit := func(v, def int64) int64 {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	packets := limit(policy.Packets, defaultRekeyPackets)
+	bytes := limit(policy.Bytes, defaultRekeyBytes)
+	interval := time.Duration(limit(int64(policy.Interval),
+		int64(defaultRekeyInterval)))
+
+	r := a.state()
+	return packets > 0 && r.packets >= packets ||
+		bytes > 0 && r.bytes >= bytes ||
+		interval > 0 && time.Since(r.time) >= interval
+}
+
+// Rekey start channel keys update. It returns ErrRekeyInProgress if previous
+// keys update does not completed yet, and ErrRekeyNotSupported in protocol
+// version 5 channels
+func (ch *Channel) Rekey() (err error) {
+	if ch.aead == nil {
+		return ErrRekeyNotSupported
+	}
+	if !ch.rekeyCompleted() {
+		return ErrRekeyInProgress
+	}
+	err = ch.aead.initiate()
+	if err != nil {
+		return
+	}
+	log.Debug.Println("channel keys updated", ch.Addr().String())
+	return
+}
+
+// KeyGeneration return channels current packet keys generation
+func (ch *Channel) KeyGeneration() uint64 {
+	if ch.aead == nil {
+		return 0
+	}
+	return ch.aead.state().generation
+}
+
+// rekeyByPolicy start keys update when current keys budget of rekey policy
+// exhausted
+func (ch *Channel) rekeyByPolicy() {
+	if !ch.aead.exhausted(ch.tru.rekeyPolicy) {
+		return
+	}
+	ch.Rekey()
+}
+
+// rekeyCompleted return true if previous keys update completed, so previous
+// keys not needed more
+func (ch *Channel) rekeyCompleted() bool {
+	r := ch.aead.state()
+	if r.generation == 0 {
+		return true
+	}
+
+	// Three retransmission timeouts passed since update
+	if time.Since(r.time) < 3*ch.stat.getRTO() {
+		return false
+	}
+
+	// Peer received packet sealed by current keys and all packets before it
+	if !r.sent {
+		return false
+	}
+	if id, ok := ch.sendQueue.oldest(); ok &&
+		ch.seq.distance(id, uint32(r.sendFirst)) >= 0 {
+		return false
+	}
+
+	// All peer packets sealed by previous keys received. If peer does not
+	// send packets by current keys, all sent packets received
+	ch.tru.mu.RLock()
+	expected := packetNumber(ch.expectedID, ch.recvEpoch)
+	ch.tru.mu.RUnlock()
+	if r.recvFirst == math.MaxUint64 {
+		return ch.recvQueue.len() == 0
+	}
+	return expected >= r.recvFirst
+}
@@ -0,0 +1,134 @@
+package tru
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestPacketKeysUpdate(t *testing.T) {
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	client, _ := newPacketAEAD(key, CipherSuiteAES256GCM, false)
+	server, _ := newPacketAEAD(key, CipherSuiteAES256GCM, true)
+
+	// seal packet by sender and open it by receiver
+	seal := func(a *packetAEAD, id uint32) (pac *Packet, data []byte) {
+		pac = &Packet{id: id, status: statusData, version: protocolVersion6}
+		data = a.sealPacket(pac, 0, []byte(fmt.Sprint("packet ", id)))
+		return
+	}
+	open := func(a *packetAEAD, pac *Packet, data []byte) error {
+		out, err := a.open(nil, pac.appendHeader(nil), data, pac.id, 0,
+			pac.flags&flagKeyPhase)
+		if err == nil && !bytes.Equal(out, []byte(fmt.Sprint("packet ", pac.id))) {
+			t.Fatalf("wrong packet %d data", pac.id)
+		}
+		return err
+	}
+
+	// Packets sealed by old and new keys
+	oldPac, oldData := seal(client, 1)
+	if err := client.initiate(); err != nil {
+		t.Fatal(err)
+	}
+	newPac, newData := seal(client, 2)
+	if oldPac.flags == newPac.flags {
+		t.Fatal("key phase does not changed")
+	}
+
+	// Server updates keys when got packet with new key phase and opens
+	// packets sealed by previous keys
+	if err := open(server, newPac, newData); err != nil {
+		t.Fatalf("can't open packet sealed by new keys, err: %s", err)
+	}
+	if server.rekey.generation != 1 {
+		t.Fatalf("server keys does not updated")
+	}
+	if err := open(server, oldPac, oldData); err != nil {
+		t.Fatalf("can't open packet sealed by previous keys, err: %s", err)
+	}
+
+	// Server sends by new keys, client opens packets sealed by server
+	// previous keys while server does not send by new keys
+	pac, data := seal(server, 1)
+	if err := open(client, pac, data); err != nil {
+		t.Fatalf("can't open server packet, err: %s", err)
+	}
+	if client.rekey.recvFirst != 1 || client.rekey.generation != 1 {
+		t.Fatal("wrong client keys update state")
+	}
+
+	// Packet with changed key phase fails authentication
+	pac, data = seal(client, 3)
+	pac.flags ^= flagKeyPhase
+	if err := open(server, pac, data); err != ErrPacketAuth {
+		t.Error("packet with changed key phase opened")
+	}
+}
+
+func TestRekey(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	const numPackets = 100
+	received := make(chan []byte, numPackets)
+	reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+		if err == nil {
+			received <- append([]byte(nil), pac.Data()...)
+		}
+		return
+	}
+
+	tru1, err := New(0, reader, log)
+	if err != nil {
+		t.Fatalf("can't start tru1, err: %s", err)
+	}
+	defer tru1.Close()
+
+	// Client updates keys every 10 packets when previous update completed
+	tru2, err := New(0, RekeyPolicy{Packets: 10}, log)
+	if err != nil {
+		t.Fatalf("can't start tru2, err: %s", err)
+	}
+	defer tru2.Close()
+
+	ch, err := tru2.Connect(tru1.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("can't connect to tru1, err: %s", err)
+	}
+	if err = ch.Rekey(); err != nil {
+		t.Fatalf("can't rekey, err: %s", err)
+	}
+	if err = ch.Rekey(); err != ErrRekeyInProgress {
+		t.Fatalf("rekey started before previous rekey completed, err: %v", err)
+	}
+
+	for i := 0; i < numPackets; i++ {
+		data := []byte(fmt.Sprint("packet ", i))
+		if _, err = ch.WriteTo(data); err != nil {
+			t.Fatalf("WriteTo err: %s", err)
+		}
+		select {
+		case out := <-received:
+			if !bytes.Equal(out, data) {
+				t.Fatalf("wrong packet %d data: %q", i, out)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d not received", i)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Both peers updated keys
+	var sch *Channel
+	tru1.ForEachChannel(func(c *Channel) { sch = c })
+	if ch.KeyGeneration() < 2 || sch.KeyGeneration() != ch.KeyGeneration() {
+		t.Errorf("wrong key generation %d, peer %d", ch.KeyGeneration(),
+			sch.KeyGeneration())
+	}
+}
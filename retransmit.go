@@ -0,0 +1,173 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Retransmit scheduler module
+
+package tru
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// retransmitScheduler is common for all tru channels retransmit scheduler. It
+// keeps sent packets in min-heap ordered by packets retransmit time and fires
+// one timer exactly when the earliest packet should be retransmitted.
+type retransmitScheduler struct {
+	heap       retransmitHeap                 // Scheduled packets min-heap
+	items      map[*Packet]*retransmitItem    // Scheduled packets index
+	timer      *time.Timer                    // Earliest packet timer
+	next       time.Time                      // Timer fire time
+	resend     func(ch *Channel, pac *Packet) // Retransmit function
+	sync.Mutex                                // Scheduler mutex
+}
+
+// retransmitItem is retransmit scheduler heap item
+type retransmitItem struct {
+	ch    *Channel  // Packets channel
+	pac   *Packet   // Scheduled packet
+	time  time.Time // Packet retransmit time
+	index int       // Index in heap
+}
+
+// retransmitHeap is retransmit items min-heap, it implements heap.Interface
+type retransmitHeap []*retransmitItem
+
+func (h retransmitHeap) Len() int           { return len(h) }
+func (h retransmitHeap) Less(i, j int) bool { return h[i].time.Before(h[j].time) }
+func (h retransmitHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *retransmitHeap) Push(x any) {
+	item := x.(*retransmitItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *retransmitHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// init retransmit scheduler, the resend function calls for each packet when
+// its retransmit time came
+func (s *retransmitScheduler) init(resend func(ch *Channel, pac *Packet)) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.items = make(map[*Packet]*retransmitItem)
+	s.resend = resend
+	s.timer = time.AfterFunc(time.Hour, s.fire)
+	s.timer.Stop()
+}
+
+// destroy retransmit scheduler
+func (s *retransmitScheduler) destroy() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.timer.Stop()
+	s.heap = nil
+	s.items = make(map[*Packet]*retransmitItem)
+}
+
+// schedule add packet to scheduler or update its retransmit time if packet
+// already scheduled
+func (s *retransmitScheduler) schedule(ch *Channel, pac *Packet) {
+	t := pac.getRetransmitTime()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if item, ok := s.items[pac]; ok {
+		item.time = t
+		heap.Fix(&s.heap, item.index)
+	} else {
+		item = &retransmitItem{ch: ch, pac: pac, time: t}
+		heap.Push(&s.heap, item)
+		s.items[pac] = item
+	}
+	s.reset()
+}
+
+// cancel remove packets from scheduler
+func (s *retransmitScheduler) cancel(pacs ...*Packet) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, pac := range pacs {
+		item, ok := s.items[pac]
+		if !ok {
+			continue
+		}
+		heap.Remove(&s.heap, item.index)
+		delete(s.items, pac)
+	}
+	s.reset()
+}
+
+// len return number of scheduled packets
+func (s *retransmitScheduler) len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.heap)
+}
+
+// reset timer to the earliest packet retransmit time, should be called under
+// lock
+func (s *retransmitScheduler) reset() {
+	if len(s.heap) == 0 {
+		s.timer.Stop()
+		s.next = time.Time{}
+		return
+	}
+	if t := s.heap[0].time; !t.Equal(s.next) {
+		s.next = t
+		s.timer.Reset(time.Until(t))
+	}
+}
+
+// fire retransmit packets which retransmit time came
+func (s *retransmitScheduler) fire() {
+	now := time.Now()
+
+	s.Lock()
+	var due []*retransmitItem
+	for len(s.heap) > 0 && !s.heap[0].time.After(now) {
+		item := heap.Pop(&s.heap).(*retransmitItem)
+		delete(s.items, item.pac)
+		due = append(due, item)
+	}
+	s.next = time.Time{}
+	s.reset()
+	s.Unlock()
+
+	for _, item := range due {
+		s.resend(item.ch, item.pac)
+	}
+}
+
+// retransmit packet from send queue or destroy channel if packet retransmit
+// attempts exceeded
+func (ch *Channel) retransmit(pac *Packet) {
+	if ch.stat.isDestroyed() {
+		return
+	}
+	if _, p, ok := ch.sendQueue.get(pac.ID()); !ok || p != pac {
+		return
+	}
+	if pac.getRetransmitAttempts() >= maxRetransmitAttempts {
+		ch.destroy(fmt.Sprint("channel max retransmit, destroy ", ch.Addr().String()))
+		return
+	}
+	ch.resend(pac)
+}
@@ -0,0 +1,120 @@
+package tru
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetransmitScheduler(t *testing.T) {
+
+	var mu sync.Mutex
+	var fired []int
+	done := make(chan struct{})
+
+	var s retransmitScheduler
+	s.init(func(ch *Channel, pac *Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		fired = append(fired, pac.ID())
+		if len(fired) == 3 {
+			close(done)
+		}
+	})
+	defer s.destroy()
+
+	// Schedule packets in reverse order, cancel one and reschedule another
+	ch := new(Channel)
+	var pacs []*Packet
+	for id := 0; id < 5; id++ {
+		pac := &Packet{id: uint32(id)}
+		pac.setRetransmitTime(time.Duration(50-id*10) * time.Millisecond)
+		s.schedule(ch, pac)
+		pacs = append(pacs, pac)
+	}
+	s.cancel(pacs[2])
+	pacs[4].setRetransmitTime(time.Hour)
+	s.schedule(ch, pacs[4])
+
+	start := time.Now()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("packets not fired: %v", fired)
+	}
+	if since := time.Since(start); since > 200*time.Millisecond {
+		t.Errorf("packets fired too late: %v", since)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(fired) != "[3 1 0]" {
+		t.Errorf("wrong fired packets order: %v", fired)
+	}
+	if s.len() != 1 {
+		t.Errorf("wrong number of scheduled packets: %d", s.len())
+	}
+}
+
+// newRetransmitBench create scheduler with numChannels channels and
+// numPackets scheduled packets in each channel
+func newRetransmitBench(numChannels, numPackets int) (s *retransmitScheduler, pacs []*Packet, chs []*Channel) {
+	s = new(retransmitScheduler)
+	s.init(func(ch *Channel, pac *Packet) {})
+	for i := 0; i < numChannels; i++ {
+		ch := new(Channel)
+		chs = append(chs, ch)
+		for id := 0; id < numPackets; id++ {
+			pac := &Packet{id: uint32(id)}
+			pac.setRetransmitTime(time.Hour + time.Duration(i*numPackets+id))
+			s.schedule(ch, pac)
+			pacs = append(pacs, pac)
+		}
+	}
+	return
+}
+
+// BenchmarkRetransmitReschedule measures retransmit time update of packet
+// (packet retransmitted) with 10k channels and 8 inflight packets per channel
+func BenchmarkRetransmitReschedule(b *testing.B) {
+	s, pacs, chs := newRetransmitBench(10000, 8)
+	defer s.destroy()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := i % len(pacs)
+		pacs[n].setRetransmitTime(time.Hour + time.Duration(i))
+		s.schedule(chs[n/8], pacs[n])
+	}
+}
+
+// BenchmarkRetransmitAck measures packet ack (cancel) and new packet send
+// (schedule) with 10k channels and 8 inflight packets per channel
+func BenchmarkRetransmitAck(b *testing.B) {
+	s, pacs, chs := newRetransmitBench(10000, 8)
+	defer s.destroy()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := i % len(pacs)
+		s.cancel(pacs[n])
+		pacs[n].setRetransmitTime(time.Hour + time.Duration(i))
+		s.schedule(chs[n/8], pacs[n])
+	}
+}
+
+// BenchmarkRetransmitFire measures fire of due packets with 10k channels and
+// 8 inflight packets per channel
+func BenchmarkRetransmitFire(b *testing.B) {
+	s, pacs, chs := newRetransmitBench(10000, 8)
+	defer s.destroy()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := i % len(pacs)
+		pacs[n].setRetransmitTime(-time.Millisecond)
+		s.schedule(chs[n/8], pacs[n])
+		s.fire()
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Connect retry and rate limit module
+
+package tru
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Server with stateless retry does not answer to connect packets without
+// valid cookie. It sends retry answer with cookie signed by servers secret
+// and bound to clients address and time, and client sends connect packet
+// again with the cookie. So server creates handshake state and channel only
+// for clients which own its source address. Retry works with protocol version
+// 6 and later clients only. Connect packets may be limited by source ip
+// before any processing, the limit is switched off by default.
+
+// StatelessRetry parameter type switch on stateless retry of connect packets
+type StatelessRetry bool
+
+// ConnectRateLimit parameter type sets per source ip rate limit of connect
+// packets: connect packets rate per second and burst. The limit is switched
+// off by default and when rate is zero or negative. Zero burst sets default
+// burst. Clients behind one NAT share the limit of its ip, so set rate for
+// expected number of clients, f.e. ConnectRateLimit{Rate: 10, Burst: 20}.
+type ConnectRateLimit struct {
+	Rate  float64 // Connect packets per second from one ip
+	Burst int     // Max connect packets burst from one ip
+}
+
+// Default connect rate limit burst
+const defaultConnectBurst = 20
+
+const (
+	retryCookieLen      = 8 + 16           // Cookie time and mac length
+	retryCookieLifetime = 10 * time.Second // Cookie valid time
+)
+
+// retry is connect retry cookies and connect rate limiter
+type retry struct {
+	secret  []byte       // Cookie secret
+	limiter rateLimiters // Connect rate limiters by ip
+}
+
+// init retry cookie secret and connect rate limiter
+func (r *retry) init(limit ConnectRateLimit) (err error) {
+	r.secret = make([]byte, 32)
+	if _, err = rand.Read(r.secret); err != nil {
+		return
+	}
+	rate := limit.Rate
+	if rate <= 0 {
+		rate = -1
+	}
+	r.limiter.init(rate, limit.Burst, -1, defaultConnectBurst)
+	return
+}
+
+// cookie return retry cookie of address created at time t
+func (r *retry) cookie(addr net.Addr, t time.Time) []byte {
+	cookie := binary.LittleEndian.AppendUint64(nil, uint64(t.Unix()))
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write([]byte("tru retry"))
+	mac.Write(cookie)
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(cookie)[:retryCookieLen]
+}
+
+// validCookie return true if cookie created for address and it is not
+// expired
+func (r *retry) validCookie(addr net.Addr, cookie []byte) bool {
+	if len(cookie) != retryCookieLen {
+		return false
+	}
+	t := time.Unix(int64(binary.LittleEndian.Uint64(cookie)), 0)
+	if age := time.Since(t); age < -time.Second || age > retryCookieLifetime {
+		return false
+	}
+	return hmac.Equal(cookie, r.cookie(addr, t))
+}
+
+// allow return true if connect packet from address allowed by rate limiter
+func (r *retry) allow(addr net.Addr) bool {
+	return r.limiter.allow(addr)
+}
+
+// retryConnect resend connect packet with servers retry cookie. Client
+// retries once per connect
+func (c *connect) retryConnect(tru *Tru, addr net.Addr, cd *connectData,
+	cookie []byte) (err error) {
+
+	c.m.Lock()
+	if cd.retry {
+		c.m.Unlock()
+		return errors.New("connect already retried")
+	}
+	cd.retry = true
+	cd.cp.options.cookie = cookie
+	cp := cd.cp
+	c.m.Unlock()
+
+	pac, err := tru.connectPacket(cp)
+	if err != nil {
+		return
+	}
+	return c.writeHandshake(tru, cd, pac, addr)
+}
+
+// serveRetry check connect packet cookie when stateless retry switched on,
+// and send retry answer if connect packet has not valid cookie. It returns
+// true if connect packet processed
+func (c *connect) serveRetry(tru *Tru, addr net.Addr, pac *Packet,
+	cp connectPacketData) (processed bool, err error) {
+
+	if !bool(tru.statelessRetry) || pac.version < protocolVersion6 {
+		return
+	}
+	if tru.retry.validCookie(addr, cp.options.cookie) {
+		tru.amplification.validate(addr)
+		return
+	}
+	processed = true
+
+	// Send retry answer with new cookie
+	cp.data = nil
+	cp.options = connectOptions{cookie: tru.retry.cookie(addr, time.Now())}
+	data, err := cp.MarshalBinary()
+	if err != nil {
+		return
+	}
+	p := tru.newPacket().SetStatus(statusConnectServerAnswer).SetData(data)
+	p.version = min(tru.version, pac.version)
+	data, err = p.MarshalBinary()
+	if err != nil {
+		return
+	}
+	err = tru.writeToStateless(data, addr, pac.Len())
+	return
+}
@@ -0,0 +1,147 @@
+package tru
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestRetryCookie(t *testing.T) {
+
+	var r retry
+	if err := r.init(ConnectRateLimit{}); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	cookie := r.cookie(addr, time.Now())
+	if !r.validCookie(addr, cookie) {
+		t.Error("valid cookie rejected")
+	}
+	if r.validCookie(other, cookie) {
+		t.Error("cookie of other address accepted")
+	}
+	if r.validCookie(addr, r.cookie(addr, time.Now().Add(-2*retryCookieLifetime))) {
+		t.Error("expired cookie accepted")
+	}
+	cookie[len(cookie)-1] ^= 1
+	if r.validCookie(addr, cookie) {
+		t.Error("tampered cookie accepted")
+	}
+	if r.validCookie(addr, nil) {
+		t.Error("empty cookie accepted")
+	}
+}
+
+func TestConnectRateLimit(t *testing.T) {
+
+	var r retry
+	if err := r.init(ConnectRateLimit{Rate: 0.001, Burst: 3}); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+
+	for i := 0; i < 3; i++ {
+		if !r.allow(addr) {
+			t.Fatalf("connect %d rejected", i)
+		}
+	}
+	if r.allow(other) {
+		t.Error("connect from the same ip allowed over burst")
+	}
+	if !r.allow(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}) {
+		t.Error("connect from other ip rejected")
+	}
+
+	// New ips share overflow limiter when limiters map is full, idle
+	// limiters removed
+	for i := 0; len(r.limiter.limiters) < rateLimitersMax; i++ {
+		r.allow(&net.UDPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 1000})
+	}
+	for i := 0; i < 3; i++ {
+		if !r.allow(&net.UDPAddr{IP: net.IPv4(10, 2, 0, byte(i)), Port: 1000}) {
+			t.Fatalf("connect %d over limiters map size rejected", i)
+		}
+	}
+	if r.allow(&net.UDPAddr{IP: net.IPv4(10, 2, 0, 10), Port: 1000}) {
+		t.Error("connect over limiters map size allowed over burst")
+	}
+	r.limiter.clean(time.Now().Add(time.Hour * 24 * 365))
+	if len(r.limiter.limiters) != 0 {
+		t.Errorf("idle limiters not removed: %d", len(r.limiter.limiters))
+	}
+
+	// Rate limit switched off by default and by negative rate
+	for _, limit := range []ConnectRateLimit{{}, {Rate: -1}} {
+		r.init(limit)
+		for i := 0; i < 100; i++ {
+			if !r.allow(addr) {
+				t.Fatal("connect rejected when rate limit switched off")
+			}
+		}
+	}
+}
+
+func TestStatelessRetry(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	server, err := New(0, StatelessRetry(true), log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1),
+		Port: server.LocalAddr().(*net.UDPAddr).Port}
+
+	// Connect packet without cookie answered with retry cookie, server does
+	// not create handshake state
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hs, _ := newHandshake("uuid", false)
+	cp := connectPacketData{uuid: []byte("uuid"), data: hs.public(), extended: true}
+	cp.options.handshake = handshakeX25519
+	data, _ := cp.MarshalBinary()
+	p := server.newPacket().SetStatus(statusConnect).SetData(data)
+	p.version = protocolVersion6
+	data, _ = p.MarshalBinary()
+	conn.WriteTo(data, addr)
+
+	buf := make([]byte, readBufferLen)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("retry answer not received, err: %s", err)
+	}
+	pac := new(Packet)
+	if err = pac.UnmarshalBinary(buf[:n]); err != nil ||
+		pac.Status() != statusConnectServerAnswer {
+		t.Fatalf("wrong retry answer, err: %v", err)
+	}
+	answer := connectPacketData{extended: true}
+	if err = answer.UnmarshalBinary(pac.Data()); err != nil ||
+		len(answer.options.cookie) != retryCookieLen || len(answer.data) != 0 {
+		t.Fatalf("wrong retry answer data, err: %v", err)
+	}
+	if _, ok := server.connect.getPending("uuid"); ok {
+		t.Error("handshake state created before retry")
+	}
+
+	// Client connects to server with stateless retry
+	client, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+	if _, err = client.Connect(addr.String()); err != nil {
+		t.Fatalf("can't connect to server, err: %s", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Retransmission timeout module (RFC 6298)
+
+package tru
+
+import "time"
+
+// Retransmission timeout constants
+const (
+	rtoAlpha       = 8        // SRTT gain is 1/rtoAlpha
+	rtoBeta        = 4        // RTTVAR gain is 1/rtoBeta
+	rtoK           = 4        // RTTVAR multiplier
+	rtoGranularity = minRTT   // Clock granularity added to RTO
+	minRTO         = minRTT   // Min retransmission timeout
+	maxRTO         = maxRTT   // Max retransmission timeout
+	startRTO       = startRTT // Retransmission timeout before first sample
+)
+
+// setRTT update smoothed trip time, trip time variation and retransmission
+// timeout with new trip time sample, should be called under statistic lock
+func (s *statistic) setRTT(tt time.Duration) {
+	if s.tripTimeMidle == 0 {
+		s.tripTimeMidle = tt
+		s.rttvar = tt / 2
+	} else {
+		delta := s.tripTimeMidle - tt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rttvar = (s.rttvar*(rtoBeta-1) + delta) / rtoBeta
+		s.tripTimeMidle = (s.tripTimeMidle*(rtoAlpha-1) + tt) / rtoAlpha
+	}
+
+	v := rtoK * s.rttvar
+	if v < rtoGranularity {
+		v = rtoGranularity
+	}
+	s.rto = s.tripTimeMidle + v
+	if s.rto < minRTO {
+		s.rto = minRTO
+	}
+	if s.rto > maxRTO {
+		s.rto = maxRTO
+	}
+}
+
+// getRTO return channels retransmission timeout
+func (s *statistic) getRTO() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.rto == 0 {
+		return startRTO
+	}
+	return s.rto
+}
+
+// getRTTVar return channels trip time variation
+func (s *statistic) getRTTVar() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.rttvar
+}
+
+// backoffRTO return retransmission timeout doubled for each retransmit
+// attempt and limited by maxRTO
+func backoffRTO(rto time.Duration, attempts int) time.Duration {
+	for ; attempts > 0 && rto < maxRTO; attempts-- {
+		rto *= 2
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	return rto
+}
+
+// RTO return channels current retransmission timeout
+func (ch *Channel) RTO() time.Duration {
+	return ch.stat.getRTO()
+}
+
+// RTTVar return channels trip time variation
+func (ch *Channel) RTTVar() time.Duration {
+	return ch.stat.getRTTVar()
+}
@@ -0,0 +1,45 @@
+package tru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTO(t *testing.T) {
+
+	var s statistic
+	if rto := s.getRTO(); rto != startRTO {
+		t.Errorf("wrong start rto: %v", rto)
+	}
+
+	// First sample: SRTT = R, RTTVAR = R/2, RTO = SRTT + 4*RTTVAR
+	s.setRTT(100 * time.Millisecond)
+	if s.tripTimeMidle != 100*time.Millisecond || s.rttvar != 50*time.Millisecond {
+		t.Errorf("wrong first sample srtt: %v, rttvar: %v", s.tripTimeMidle, s.rttvar)
+	}
+	if rto := s.getRTO(); rto != 300*time.Millisecond {
+		t.Errorf("wrong first sample rto: %v", rto)
+	}
+
+	// Next sample: RTTVAR = 3/4*RTTVAR + 1/4*|SRTT-R|, SRTT = 7/8*SRTT + 1/8*R
+	s.setRTT(20 * time.Millisecond)
+	if s.rttvar != 57500*time.Microsecond || s.tripTimeMidle != 90*time.Millisecond {
+		t.Errorf("wrong next sample srtt: %v, rttvar: %v", s.tripTimeMidle, s.rttvar)
+	}
+
+	// Stable trip time reduces RTO to SRTT plus clock granularity
+	for i := 0; i < 100; i++ {
+		s.setRTT(time.Millisecond)
+	}
+	if rto := s.getRTO(); rto != s.tripTimeMidle+rtoGranularity {
+		t.Errorf("wrong stable rto: %v", rto)
+	}
+
+	// Exponential backoff
+	if rto := backoffRTO(minRTO, 3); rto != 8*minRTO {
+		t.Errorf("wrong backoff rto: %v", rto)
+	}
+	if rto := backoffRTO(minRTO, 100); rto != maxRTO {
+		t.Errorf("wrong max backoff rto: %v", rto)
+	}
+}
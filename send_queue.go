@@ -8,45 +8,206 @@ package tru
 
 import (
 	"container/list"
-	"fmt"
+	"context"
+	"math/rand"
 	"sync"
 	"time"
 )
 
 type sendQueue struct {
-	queue           list.List                // Send queue list
-	index           map[uint32]*list.Element // Send queue index
-	sync.RWMutex                             // Send queue mutex
-	retransmitTimer *time.Timer              // Send queue retransmit Timer
+	queue        list.List                // Send queue list
+	index        map[uint32]*list.Element // Send queue index
+	pending      list.List                // Packets wait congestion window
+	bytes        int                      // Inflight packets data bytes
+	pendingBytes int                      // Pending packets data bytes
+	limit        SendQueueLimit           // Send queue limits
+	window       uint32                   // Peer receive window, packets
+	seq          seqSpace                 // Packet ID sequence space
+	cond         *sync.Cond               // Send queue space freed
+	destroyed    bool                     // Send queue destroyed
+	sync.RWMutex                          // Send queue mutex
 }
 
 const (
-	minRTT                = 30 * time.Millisecond
-	maxRTT                = 3000 * time.Millisecond
-	startRTT              = 200 * time.Millisecond
-	maxRetransmitAttempts = 100
+	minRTT                  = 30 * time.Millisecond
+	maxRTT                  = 3000 * time.Millisecond
+	startRTT                = 200 * time.Millisecond
+	maxRetransmitAttempts   = 100
+	fastRetransmitThreshold = 3 // Number of acks after not acknowledged packet
+)
+
+// SendQueueLimit parameter type sets channels send queue limits: max number
+// of packets and data bytes which sent and not acknowledged yet or wait
+// sending. Writers wait (or get ErrWouldBlock) while send queue is full.
+// Zero values set defaults, negative values switch limit off.
+type SendQueueLimit struct {
+	Packets int // Max number of packets in send queue
+	Bytes   int // Max packets data bytes in send queue
+}
+
+// Default send queue limits
+const (
+	defaultSendQueuePackets = 4096
+	defaultSendQueueBytes   = 16 * 1024 * 1024
 )
 
 // init send queue
-func (s *sendQueue) init(ch *Channel) {
+func (s *sendQueue) init(limit SendQueueLimit, seq seqSpace) {
 	s.index = make(map[uint32]*list.Element)
-	s.retransmit(ch)
+	s.limit = limit
+	s.seq = seq
+	s.window = ackNoWindow
+	s.cond = sync.NewCond(s)
+}
+
+// destroy send queue, return packets from send queue
+func (s *sendQueue) destroy() (pacs []*Packet) {
+	s.Lock()
+	defer s.Unlock()
+
+	for e := s.queue.Front(); e != nil; e = e.Next() {
+		pacs = append(pacs, e.Value.(*Packet))
+	}
+	s.pending.Init()
+	s.pendingBytes = 0
+	s.destroyed = true
+	s.cond.Broadcast()
+	return
+}
+
+// push packet to pending queue, packets from pending queue moves to send queue
+// and sends by flush
+func (s *sendQueue) push(pac *Packet) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending.PushBack(pac)
+	s.pendingBytes += len(pac.data)
+}
+
+// full return true if packets with number and data bytes does not fit to send
+// queue limits and peer receive window. Empty send queue accepts any packets.
+// Should be called under lock
+func (s *sendQueue) full(packets, bytes int) bool {
+	n := s.queue.Len() + s.pending.Len()
+	switch {
+	case n == 0:
+		return false
+	case uint64(n+packets) > uint64(s.window):
+		return true
+	case s.limit.Packets > 0 && n+packets > s.limit.Packets:
+		return true
+	case s.limit.Bytes > 0 && s.bytes+s.pendingBytes+bytes > s.limit.Bytes:
+		return true
+	}
+	return false
 }
 
-// destroy send queue
-func (s *sendQueue) destroy() {
+// fits return true if packets with number and data bytes fits to send queue
+func (s *sendQueue) fits(packets, bytes int) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return !s.full(packets, bytes)
+}
+
+// wait blocks while packets with number and data bytes does not fit to send
+// queue or context done
+func (s *sendQueue) wait(ctx context.Context, packets, bytes int) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.Lock()
+		defer s.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+
 	s.Lock()
 	defer s.Unlock()
-	s.retransmitTimer.Stop()
+
+	for !s.destroyed && ctx.Err() == nil && s.full(packets, bytes) {
+		s.cond.Wait()
+	}
+	switch {
+	case s.destroyed:
+		return ErrChannelDestroyed
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	return nil
+}
+
+// flush moves packets from pending queue to send queue and sends it while
+// channels congestion controller and peer receive window allows. Packets sent
+// to write channel after send queue unlocked, so full write channel does not
+// block other send queue users. If nonblock parameter is true flush does not
+// wait: packets which does not fit to write channel sent by goroutine
+func (s *sendQueue) flush(ch *Channel, nonblock ...bool) {
+	pacs := s.next(ch)
+	if len(nonblock) > 0 && nonblock[0] {
+		for len(pacs) > 0 && ch.tryWriteToSender(pacs[0]) {
+			pacs = pacs[1:]
+		}
+		if len(pacs) > 0 {
+			go s.send(ch, pacs)
+		}
+		return
+	}
+	s.send(ch, pacs)
+}
+
+// send writes packets to write channel
+func (s *sendQueue) send(ch *Channel, pacs []*Packet) {
+	for _, pac := range pacs {
+		ch.writeToSender(pac)
+	}
 }
 
-// add packet to send queue
-func (s *sendQueue) add(pac *Packet) {
+// next moves packets from pending queue to send queue while channels
+// congestion controller and peer receive window allows, and return packets
+// to send
+func (s *sendQueue) next(ch *Channel) (pacs []*Packet) {
+	cc := ch.congestion()
+
 	s.Lock()
 	defer s.Unlock()
+	defer s.cond.Broadcast()
+
+	for e := s.pending.Front(); e != nil; e = s.pending.Front() {
+		if n := s.queue.Len(); n > 0 && uint32(n) >= s.window {
+			return
+		}
+		if !cc.CanSend(s.bytes) {
+			return
+		}
+		pac := s.pending.Remove(e).(*Packet)
+		s.pendingBytes -= len(pac.data)
+
+		// Add packet to send queue and set packet retransmit time
+		ch.setRetransmitTime(pac)
+		s.add(pac, true)
+		cc.OnSent(len(pac.data))
+
+		// Drop packet for testing if drop flag is set. Drops every value of
+		// drop packet. If drop contain 5 than every 5th packet will be dropped
+		if *drop > 0 && !ch.serverMode && rand.Intn(*drop) == 0 {
+			continue
+		}
+
+		pacs = append(pacs, pac)
+	}
+	return
+}
+
+// add packet to send queue. Does not lock/unlock if seconf parameter true
+func (s *sendQueue) add(pac *Packet, unsafe ...bool) {
+	if len(unsafe) == 0 || !unsafe[0] {
+		s.Lock()
+		defer s.Unlock()
+	}
 
 	id := uint32(pac.ID())
 	s.index[id] = s.queue.PushBack(pac)
+	s.bytes += len(pac.data)
 	log.Debugvvv.Println("add to send queue", pac.ID())
 }
 
@@ -59,6 +220,7 @@ func (s *sendQueue) delete(id int) (pac *Packet, ok bool) {
 	if ok {
 		s.queue.Remove(e)
 		delete(s.index, uint32(id))
+		s.bytes -= len(pac.data)
 		log.Debugvvv.Println("delete from send queue", pac.ID())
 	}
 	return
@@ -92,6 +254,21 @@ func (s *sendQueue) getFirst() (pac *Packet) {
 	return
 }
 
+// oldest return id of oldest packet in send queue or in pending packets
+func (s *sendQueue) oldest() (id uint32, ok bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	e := s.queue.Front()
+	if e == nil {
+		e = s.pending.Front()
+	}
+	if e == nil {
+		return
+	}
+	return e.Value.(*Packet).id, true
+}
+
 // getRetransmitAttempts return retransmit attmenpts of first queu element or
 // 0 if queue is empty
 func (s *sendQueue) getRetransmitAttempts() (rta int) {
@@ -103,56 +280,101 @@ func (s *sendQueue) getRetransmitAttempts() (rta int) {
 	return pac.getRetransmitAttempts()
 }
 
-// len return send queue len
-func (s *sendQueue) len() int {
-	s.RLock()
-	defer s.RUnlock()
-
-	return len(s.index)
-}
-
-// retransmit packets from send queue
-func (s *sendQueue) retransmit(ch *Channel) {
+// ack delete packets acknowledged by cumulative ack and SACK ranges from send
+// queue. Returns deleted packets and holes to fast retransmit
+func (s *sendQueue) ack(ack *ackPacketData) (acked, holes []*Packet) {
 	s.Lock()
 	defer s.Unlock()
 
-	s.retransmitTimer = time.AfterFunc( /* minRTT */ 100*time.Millisecond, func() {
-
-		s.RLock()
+	remove := func(e *list.Element) *list.Element {
+		next := e.Next()
+		pac := e.Value.(*Packet)
+		s.queue.Remove(e)
+		delete(s.index, pac.id)
+		s.bytes -= len(pac.data)
+		acked = append(acked, pac)
+		return next
+	}
 
-		// Retransmit packets from send queue while retransmit
-		// time before now
-		for e := s.queue.Front(); e != nil; e = e.Next() {
+	// Cumulative ack: packets in send queue sorted by id, so delete packets
+	// from the front of queue while id less than expected id
+	for e := s.queue.Front(); e != nil; {
+		pac := e.Value.(*Packet)
+		if s.seq.distance(ack.expectedID, pac.id) >= 0 {
+			break
+		}
+		e = remove(e)
+	}
 
-			// Check retransmit time
-			pac := e.Value.(*Packet)
-			if !pac.getRetransmitTime().Before(time.Now()) {
-				// break
-				continue
+	// Selective ack ranges. Ranges longer than send queue processed by send
+	// queue packets
+	for _, r := range ack.ranges {
+		l := s.seq.distance(r.first, r.last)
+		if l < 0 {
+			continue
+		}
+		if l >= s.queue.Len() {
+			for e := s.queue.Front(); e != nil; {
+				pac := e.Value.(*Packet)
+				if s.seq.distance(r.first, pac.id) < 0 ||
+					s.seq.distance(pac.id, r.last) < 0 {
+					e = e.Next()
+					continue
+				}
+				e = remove(e)
 			}
-
-			// Resend packet and set new retransmitTime
-			rta := pac.retransmitAttempts + 1
-			pac.setRetransmitAttempts(rta)
-			if rta > maxRetransmitAttempts {
-				s.RUnlock()
-				ch.destroy(fmt.Sprint("channel max retransmit, destroy ", ch.addr.String()))
-				return
+			continue
+		}
+		for id := r.first; ; id = s.seq.next(id) {
+			if e, ok := s.index[id]; ok {
+				remove(e)
+			}
+			if id == r.last {
+				break
 			}
-			ch.setRetransmitTime(pac)
+		}
+	}
 
-			// Send to write channel
-			ch.writeToSender(pac)
-			ch.stat.setRetransmit()
+	// Holes before highest selective acknowledged packet
+	if highest, ok := ack.highest(); ok {
+		holes = s.holes(highest)
+	}
 
-			// Does not retranmit another packets if this has more than 1
-			// retransmit attempts
-			// if pac.retransmitAttempts > 1 {
-			// 	break
-			// }
+	return
+}
+
+// holes return not acknowledged packets sent before highest acknowledged
+// packet which got fastRetransmitThreshold such acks. Should be called under
+// lock
+func (s *sendQueue) holes(highest uint32) (holes []*Packet) {
+	for e := s.queue.Front(); e != nil; e = e.Next() {
+		pac := e.Value.(*Packet)
+		if s.seq.distance(highest, pac.id) >= 0 {
+			break
 		}
+		pac.dupAcks++
+		if pac.dupAcks < fastRetransmitThreshold {
+			continue
+		}
+		pac.dupAcks = 0
+		holes = append(holes, pac)
+	}
+	return
+}
 
-		s.RUnlock()
-		s.retransmit(ch)
-	})
+// ackHoles return holes to fast retransmit when packet with highest id
+// acknowledged by ack without SACK ranges
+func (s *sendQueue) ackHoles(highest uint32) (holes []*Packet) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.holes(highest)
+}
+
+// len return send queue len
+func (s *sendQueue) len() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.index)
 }
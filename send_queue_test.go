@@ -0,0 +1,137 @@
+package tru
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSendQueueLimit(t *testing.T) {
+
+	var s sendQueue
+	s.init(SendQueueLimit{Packets: 2, Bytes: 100}, seqSpace20)
+
+	// Empty send queue accepts any packets
+	if !s.fits(10, 1000) {
+		t.Errorf("empty send queue does not accept packets")
+	}
+
+	// Packets limit
+	s.push(&Packet{id: 0, data: make([]byte, 10)})
+	if !s.fits(1, 10) {
+		t.Errorf("send queue does not accept packet")
+	}
+	s.push(&Packet{id: 1, data: make([]byte, 10)})
+	if s.fits(1, 10) {
+		t.Errorf("send queue accept packet more than packets limit")
+	}
+
+	// Bytes limit
+	s.limit.Packets = 0
+	if !s.fits(1, 80) || s.fits(1, 81) {
+		t.Errorf("wrong bytes limit")
+	}
+
+	// Peer receive window
+	s.setWindow(2)
+	if s.fits(1, 10) {
+		t.Errorf("send queue accept packet more than peer window")
+	}
+
+	// Wait with context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.wait(ctx, 1, 10); err != context.DeadlineExceeded {
+		t.Errorf("wrong wait error: %v", err)
+	}
+
+	// Wait wakes up when window opened
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.setWindow(3)
+	}()
+	if err := s.wait(context.Background(), 1, 10); err != nil {
+		t.Errorf("wrong wait error: %v", err)
+	}
+
+	// Wait wakes up when send queue destroyed
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.destroy()
+	}()
+	if err := s.wait(context.Background(), 2, 10); err != ErrChannelDestroyed {
+		t.Errorf("wrong wait error: %v", err)
+	}
+}
+
+func TestSendQueueFlush(t *testing.T) {
+
+	// Channel with write channel without sender
+	tru := &Tru{senderCh: make(chan senderChData)}
+	tru.retransmit.init(func(*Channel, *Packet) {})
+	defer tru.retransmit.destroy()
+	ch := &Channel{tru: tru}
+	ch.SetCongestionController(NewRenoCongestion())
+	ch.sendQueue.init(SendQueueLimit{}, seqSpace20)
+
+	// Flush blocked by full write channel does not lock send queue
+	ch.sendQueue.push(&Packet{id: 0, data: make([]byte, 10)})
+	flushed := make(chan struct{})
+	go func() {
+		ch.sendQueue.flush(ch)
+		close(flushed)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		ch.sendQueue.fits(1, 10)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("send queue locked by blocked flush")
+	}
+	<-tru.senderCh
+	<-flushed
+}
+
+func TestSendQueueTryWrite(t *testing.T) {
+
+	// Channel with full write channel without sender
+	tru := &Tru{senderCh: make(chan senderChData, 1)}
+	tru.retransmit.init(func(*Channel, *Packet) {})
+	defer tru.retransmit.destroy()
+	ch := &Channel{tru: tru}
+	ch.SetCongestionController(NewRenoCongestion())
+	ch.sendQueue.init(SendQueueLimit{}, seqSpace20)
+	tru.senderCh <- senderChData{}
+
+	// TryWriteTo does not write to full write channel
+	if _, err := ch.TryWriteTo([]byte("data")); err != ErrWouldBlock {
+		t.Fatal("wrong try write error:", err)
+	}
+
+	// Non blocking flush does not wait write channel
+	ch.sendQueue.push(&Packet{id: 0, data: make([]byte, 10)})
+	ch.sendQueue.push(&Packet{id: 1, data: make([]byte, 10)})
+	done := make(chan struct{})
+	go func() {
+		ch.sendQueue.flush(ch, true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("non blocking flush blocked by full write channel")
+	}
+
+	// Packets sent when write channel freed
+	for i := 0; i < 3; i++ {
+		select {
+		case <-tru.senderCh:
+		case <-time.After(time.Second):
+			t.Fatal("packets was not sent to write channel")
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Sequence numbers module
+
+package tru
+
+// seqSpace is number of channels packet ids. Protocol version 5 channels use
+// 20 bit packet ids of short header, protocol version 6 channels use 32 bit
+// sequence numbers of long header. Packet ids order resolved modulo sequence
+// space, so 32 bit ids wrap after 2^31 packets in flight instead of 2^19.
+// Zero value is protocol version 5 sequence space.
+type seqSpace uint64
+
+const (
+	seqSpace20 seqSpace = packetIDLimit // Protocol version 5 sequence space
+	seqSpace32 seqSpace = 1 << 32       // Protocol version 6 sequence space
+)
+
+// newSeqSpace return sequence space of protocol version
+func newSeqSpace(version uint8) seqSpace {
+	if version >= protocolVersion6 {
+		return seqSpace32
+	}
+	return seqSpace20
+}
+
+// size return number of packet ids in sequence space
+func (s seqSpace) size() uint64 {
+	if s == 0 {
+		return uint64(seqSpace20)
+	}
+	return uint64(s)
+}
+
+// distance return distance from id to next id: integer value less than zero
+// if 'next < id' or integer value more than zero if 'next > id'
+func (s seqSpace) distance(id, next uint32) int {
+	size := s.size()
+	diff := (uint64(next)%size + size - uint64(id)%size) % size
+	if diff < size/2 {
+		return int(diff)
+	}
+	return int(int64(diff) - int64(size))
+}
+
+// next return id next to id
+func (s seqSpace) next(id uint32) uint32 {
+	return uint32((uint64(id) + 1) % s.size())
+}
+
+// Channel sender and receiver count epochs, number of sequence space
+// wraparounds. Epoch extends 32 bit packet id to 64 bit packet number which
+// never repeats during channel live and used in packet key derivation.
+// Protocol version 5 channels always have zero epoch to be compatible with
+// version 5 peers.
+
+// packetNumber return 64 bit packet number of id and id epoch
+func packetNumber(id, epoch uint32) uint64 {
+	return uint64(epoch)<<32 | uint64(id)
+}
+
+// nextEpoch return next epoch when id wrapped
+func (ch *Channel) nextEpoch(epoch uint32) uint32 {
+	if ch.seq != seqSpace32 {
+		return epoch
+	}
+	return epoch + 1
+}
+
+// packetEpoch return epoch of received packet. Packets with id near expected
+// id may belong to previous or next epoch
+func (ch *Channel) packetEpoch(id uint32) uint32 {
+	ch.tru.mu.RLock()
+	expectedID, epoch := ch.expectedID, ch.recvEpoch
+	ch.tru.mu.RUnlock()
+
+	if ch.seq != seqSpace32 {
+		return 0
+	}
+	dist := ch.seq.distance(expectedID, id)
+	switch {
+	case dist > 0 && id < expectedID:
+		epoch++
+	case dist < 0 && id > expectedID:
+		epoch--
+	}
+	return epoch
+}
@@ -0,0 +1,121 @@
+package tru
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestSeqSpace(t *testing.T) {
+
+	tests := []struct {
+		seq      seqSpace
+		id, next uint32
+		distance int
+	}{
+		{seqSpace20, 10, 20, 10},
+		{seqSpace20, 20, 10, -10},
+		{seqSpace20, packetIDLimit - 1, 0, 1},
+		{seqSpace20, 0, packetIDLimit - 1, -1},
+		{seqSpace32, 0xFFFFFFFF, 0, 1},
+		{seqSpace32, 0, 0xFFFFFFFF, -1},
+		{seqSpace32, 0xFFFFFFF0, 0x10, 0x20},
+		{seqSpace32, 0, packetIDLimit, packetIDLimit},
+		{seqSpace32, 0, 0x80000000, -0x80000000},
+	}
+	for _, test := range tests {
+		if d := test.seq.distance(test.id, test.next); d != test.distance {
+			t.Errorf("wrong distance %x -> %x: %d, expected %d", test.id,
+				test.next, d, test.distance)
+		}
+	}
+
+	if seqSpace20.next(packetIDLimit-1) != 0 || seqSpace32.next(packetIDLimit-1) !=
+		packetIDLimit || seqSpace32.next(0xFFFFFFFF) != 0 {
+		t.Error("wrong next id")
+	}
+
+	// Received packets epoch
+	ch := &Channel{tru: new(Tru), seq: seqSpace32, expectedID: 0xFFFFFFF0, recvEpoch: 3}
+	if e := ch.packetEpoch(5); e != 4 {
+		t.Errorf("wrong next epoch: %d", e)
+	}
+	if e := ch.packetEpoch(0xFFFFFFE0); e != 3 {
+		t.Errorf("wrong epoch: %d", e)
+	}
+	ch.expectedID, ch.recvEpoch = 2, 4
+	if e := ch.packetEpoch(0xFFFFFFFE); e != 3 {
+		t.Errorf("wrong previous epoch: %d", e)
+	}
+}
+
+func TestSeqWraparound(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	const numPackets = 40
+	received := make(chan []byte, numPackets)
+	reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+		if err == nil {
+			received <- append([]byte(nil), pac.Data()...)
+		}
+		return
+	}
+
+	tru1, err := New(0, reader, log)
+	if err != nil {
+		t.Fatalf("can't start tru1, err: %s", err)
+	}
+	defer tru1.Close()
+
+	tru2, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start tru2, err: %s", err)
+	}
+	defer tru2.Close()
+
+	ch, err := tru2.Connect(tru1.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("can't connect to tru1, err: %s", err)
+	}
+
+	// Move send and expected ids close to 32 bit wraparound
+	const startID = 0xFFFFFFFF - numPackets/2
+	tru1.ForEachChannel(func(sch *Channel) {
+		tru1.mu.Lock()
+		sch.expectedID = startID
+		tru1.mu.Unlock()
+	})
+	tru2.mu.Lock()
+	ch.id = startID
+	tru2.mu.Unlock()
+
+	// Send short (xor encrypted) and long (aes encrypted) packets
+	for i := 0; i < numPackets; i++ {
+		data := []byte(fmt.Sprint("packet ", i))
+		if i%2 == 1 {
+			data = append(data, bytes.Repeat([]byte{'.'}, 100)...)
+		}
+		if _, err = ch.WriteTo(data); err != nil {
+			t.Fatalf("WriteTo err: %s", err)
+		}
+		select {
+		case out := <-received:
+			if !bytes.Equal(out, data) {
+				t.Fatalf("wrong packet %d data: %q", i, out)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d not received", i)
+		}
+	}
+
+	tru2.mu.RLock()
+	defer tru2.mu.RUnlock()
+	if ch.sendEpoch != 1 {
+		t.Errorf("wrong send epoch %d", ch.sendEpoch)
+	}
+}
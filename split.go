@@ -6,16 +6,30 @@
 
 package tru
 
+// splitDataLen return max data length of splitted packets
+func (ch *Channel) splitDataLen() int {
+	if ch.maxDataLen != 0 {
+		return ch.maxDataLen
+	}
+	var pac Packet
+	return pac.MaxDataLen()
+}
+
+// splitNum return number of packets to send data
+func (ch *Channel) splitNum(data []byte) int {
+	maxDataLen := ch.splitDataLen()
+	if len(data) <= maxDataLen {
+		return 1
+	}
+	return (len(data) + maxDataLen - 1) / maxDataLen
+}
+
 // splitPacket split lage packet
-func (ch *Channel) splitPacket(data []byte, writeTo func(data []byte, split int) (int, error)) (rid int, err error) {
+func (ch *Channel) splitPacket(data []byte,
+	writeTo func(data []byte, split int) (int, error)) (rid int, err error) {
+
 	var id int
-	var pac Packet
-	var maxDataLen = func() int {
-		if ch.maxDataLen != 0 {
-			return ch.maxDataLen
-		}
-		return pac.MaxDataLen()
-	}()
+	var maxDataLen = ch.splitDataLen()
 	for i := 0; ; i++ {
 		if len(data) <= maxDataLen {
 			id, err = writeTo(data, 0)
@@ -53,10 +67,12 @@ func (c *combinePacket) packet(pac *Packet) (retPac *Packet) {
 	// Continue combine
 	case c.combine && pac.status == statusDataNext:
 		c.data = append(c.data, pac.Data()...)
+		pac.Release()
 
 	// End combine
 	case c.combine && pac.status == statusData:
 		c.data = append(c.data, pac.Data()...)
+		pac.Release()
 		retPac = c.first
 		retPac.SetData(c.data[:]).SetStatus(statusData)
 		c.clear()
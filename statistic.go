@@ -22,20 +22,23 @@ type statistic struct {
 	started            time.Time   // Channel started time
 	lastActivity       time.Time   // Last activity in channel (last received)
 	lastSend           time.Time   // Last send to remote peer
-	lastDelayCheck     time.Time   // Last delay check
 	checkActivityTimer *time.Timer // Check activity timer
-	sendDelay          int         // Client send delay
-
-	tripTime      time.Duration
-	tripTimeMidle time.Duration
-	send          int64 // Number of send packets
-	sendSpeed     speed // Send speed in packets/sec
-	ackRecv       int64 // Number of ack to send received
-	ackRecvDrop   int64 // Number of dropped ack to send received
-	retransmit    int64 // Number of retransmit send packets
-	recv          int64 // Number of received packets
-	recvSpeed     speed // Receive speed in packets/sec
-	drop          int64 // Number of droped received packets, duplicate packets
+
+	tripTime      time.Duration // Last trip time sample
+	tripTimeMidle time.Duration // Smoothed trip time (SRTT)
+	rttvar        time.Duration // Trip time variation (RTTVAR)
+	rto           time.Duration // Retransmission timeout
+	send          int64         // Number of send packets
+	sendSpeed     speed         // Send speed in packets/sec
+	ackRecv       int64         // Number of ack to send received
+	ackRecvDrop   int64         // Number of dropped ack to send received
+	retransmit    int64         // Number of retransmit send packets
+	fastRetransm  int64         // Number of fast retransmit send packets
+	recv          int64         // Number of received packets
+	recvSpeed     speed         // Receive speed in packets/sec
+	drop          int64         // Number of droped received packets, duplicate packets
+	duplicate     int64         // Number of duplicate (retransmitted or replayed) received packets
+	forged        int64         // Number of received packets failed authentication
 
 	sync.RWMutex
 }
@@ -133,6 +136,14 @@ func (s *statistic) setRetransmit() {
 	s.retransmit++
 }
 
+// setFastRetransmit set channels fast retransmit packet
+func (s *statistic) setFastRetransmit() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.fastRetransm++
+}
+
 // setDrop set channels drop packet
 func (s *statistic) setDrop() {
 	s.Lock()
@@ -141,20 +152,22 @@ func (s *statistic) setDrop() {
 	s.drop++
 }
 
-// setSendDelay set channels send delay
-func (s *statistic) setSendDelay(sendDelay int) {
+// setDuplicate set channels duplicate packet dropped
+func (s *statistic) setDuplicate() {
 	s.Lock()
 	defer s.Unlock()
 
-	s.sendDelay = sendDelay
+	s.drop++
+	s.duplicate++
 }
 
-// getSendDelay return channels send delay
-func (s *statistic) getSendDelay() int {
-	s.RLock()
-	defer s.RUnlock()
+// setForged set channels forged packet dropped
+func (s *statistic) setForged() {
+	s.Lock()
+	defer s.Unlock()
 
-	return s.sendDelay
+	s.drop++
+	s.forged++
 }
 
 // setLastSend set channels last send time
@@ -202,7 +215,8 @@ type ChannelStatistic struct {
 	Addr  string  // peer address
 	Send  int64   // send packets
 	Ssec  int64   // send per second
-	Rsnd  int64   // resend packets
+	Rsnd  int64   // resend packets by retransmit timeout
+	Frsn  int64   // fast resend packets
 	Ack   int64   // ack packet received
 	AckD  int64   // ack packet  received and droped (duplicate ack)
 	Recv  int64   // receive packets
@@ -211,8 +225,14 @@ type ChannelStatistic struct {
 	SQ    uint    // send queue length
 	RQ    uint    // receive queue length
 	RTA   int     // first packet retransmit attempt
-	Delay int     // client send delay
+	Delay int     // congestion controller pacing delay
 	TT    float64 // trip time
+	RTO   float64 // retransmission timeout
+	RTTV  float64 // trip time variation
+	BW    float64 // congestion controller estimated bandwidth, KB/sec
+	MinTT float64 // congestion controller estimated min trip time
+	Dupl  int64   // duplicate (retransmitted or replayed) received packets
+	Frgd  int64   // forged received packets
 }
 
 type ChannelsStatistic []ChannelStatistic
@@ -245,10 +265,11 @@ func (tru *Tru) Statistic() (stat ChannelsStatistic) {
 	for _, ch := range tru.channels {
 		ch.stat.RLock()
 		stat = append(stat, ChannelStatistic{
-			Addr: ch.addr.String(),
+			Addr: ch.Addr().String(),
 			Send: ch.stat.send,
 			Ssec: int64(ch.stat.sendSpeed.get()),
 			Rsnd: ch.stat.retransmit,
+			Frsn: ch.stat.fastRetransm,
 			Ack:  ch.stat.ackRecv,
 			AckD: ch.stat.ackRecvDrop,
 			Recv: ch.stat.recv,
@@ -257,9 +278,17 @@ func (tru *Tru) Statistic() (stat ChannelsStatistic) {
 			// SQ:  get in getRetransmitAttempts()
 			RQ: uint(ch.recvQueue.len()),
 			// RTA: get in getRetransmitAttempts()
-			Delay: ch.stat.sendDelay,
+			Delay: int(ch.congestion().PacingDelay().Microseconds()),
 			TT:    float64(ch.stat.tripTimeMidle.Microseconds()) / 1000.0,
+			RTO:   float64(ch.stat.rto.Microseconds()) / 1000.0,
+			RTTV:  float64(ch.stat.rttvar.Microseconds()) / 1000.0,
+			Dupl:  ch.stat.duplicate,
+			Frgd:  ch.stat.forged,
 		})
+		if e, ok := ch.congestion().(CongestionEstimator); ok {
+			stat[i].BW = e.Bandwidth() / 1024.0
+			stat[i].MinTT = float64(e.MinRTT().Microseconds()) / 1000.0
+		}
 		ch.stat.RUnlock()
 		getRetransmitAttempts(stat, ch, i)
 		i++
@@ -282,17 +311,21 @@ func (cs *ChannelsStatistic) String(cleanLine ...bool) string {
 	numRows := len(*cs)
 
 	// Create new simple table
-	formats := make([]string, 14)
+	formats := make([]string, 21)
 	formats[2] = "%5d"
-	formats[7] = "%5d"
-	formats[9] = "%3d"
+	formats[8] = "%5d"
 	formats[10] = "%3d"
-	formats[13] = "%.3f"
+	formats[11] = "%3d"
+	formats[14] = "%.3f"
+	formats[15] = "%.3f"
+	formats[16] = "%.3f"
+	formats[17] = "%.1f"
+	formats[18] = "%.3f"
 	st := new(stable.Stable).Lines().
-		Aligns(0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1).
+		Aligns(0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1).
 		Formats(formats...)
 	if numRows > 1 {
-		st.Totals(&ChannelStatistic{}, 0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1)
+		st.Totals(&ChannelStatistic{}, 0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1)
 	}
 	if len(cleanLine) > 0 && cleanLine[0] {
 		st.CleanLine()
@@ -353,13 +386,14 @@ func (tru *Tru) printStatistic(prnt bool) {
 		str += term.Func.WrapOff()
 
 		// Table and title
-		str += fmt.Sprintf(term.Func.ClearLine()+"TRU %s, RCH: %d, SCH: %d, run time: %v\n"+
+		str += fmt.Sprintf(term.Func.ClearLine()+"TRU %s, RCH: %d, SCH: %d, run time: %v, dropped %v\n"+
 			term.Func.ClearLine()+"%s\n"+
 			term.Func.ClearLine(),
 			tru.LocalAddr().String(),
 			len(tru.readerCh),
 			len(tru.senderCh),
 			time.Since(tru.start),
+			tru.LimitStatistic(),
 			table,
 		)
 
@@ -0,0 +1,445 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Session tickets module
+
+package tru
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Server issues session ticket to client in connect done packet. Ticket is
+// resumption secret derived from session key and clients identity encrypted
+// by servers ticket key, so server keeps nothing. Client saves ticket with
+// resumption secret in ticket cache by server address, and next connect to
+// this address resumes session by abbreviated handshake in one round trip:
+//
+//	statusConnect:             -> e, ticket, binder
+//	statusConnectServerAnswer: <- e, ee, finished, new ticket
+//
+// Binder and finished are HMACs by keys derived from resumption secret, they
+// prove both peers know the secret. New session key derived from resumption
+// secret and ephemeral Diffie-Hellman secret, so resumed session has forward
+// secrecy. Server which can't open ticket continues full X25519 handshake
+// with clients ephemeral key. Each ticket used once, client gets new ticket
+// in resumed connect. Session tickets require protocol version 6, client does
+// not use ticket when it sends hello data.
+//
+// Connect packet with ticket may be replayed by attacker. Server keeps used
+// tickets in strike register until they expire and continues full handshake
+// when ticket already used. Replayed packet can't be answered by attacker
+// without resumption secret, so server calls ConnectFunc of resumed channel
+// when first authenticated data packet received from client.
+
+// SessionTickets parameter type switch session resumption tickets. Server
+// issues tickets to connected clients and client resumes session by ticket
+// when it connects to the same address again. It is switched on by default.
+type SessionTickets bool
+
+const (
+	ticketLifetime    = 24 * time.Hour // Session ticket lifetime
+	ticketCacheMax    = 1024           // Max number of tickets in client cache
+	ticketStrikeMax   = 16384          // Max number of used tickets in strike register
+	ticketKeyLen      = 32             // Ticket key length
+	ticketPlainLen    = 8 + handshakeKeyLen + ed25519.PublicKeySize
+	resumeProtocol    = "TRU_RESUME_25519_SHA256"
+	resumptionLabel   = "tru resumption"
+	resumeBinderLabel = "tru resume binder"
+)
+
+var errTicket = errors.New("wrong session ticket")
+
+// sessionTicket is session ticket saved in client ticket cache
+type sessionTicket struct {
+	ticket  []byte            // Encrypted ticket
+	secret  []byte            // Resumption secret
+	peerKey ed25519.PublicKey // Servers identity key
+	time    time.Time         // Ticket received time
+}
+
+// tickets is servers ticket key and used tickets, and clients ticket cache
+type tickets struct {
+	key   []byte                          // Server ticket encryption key
+	used  map[[sha256.Size]byte]time.Time // Used tickets expire time by ticket hash
+	cache map[string]*sessionTicket       // Client tickets by server address
+	sync.Mutex
+}
+
+// init create ticket key and ticket cache
+func (t *tickets) init() (err error) {
+	t.key = make([]byte, ticketKeyLen)
+	if _, err = rand.Read(t.key); err != nil {
+		return
+	}
+	t.used = make(map[[sha256.Size]byte]time.Time)
+	t.cache = make(map[string]*sessionTicket)
+	return
+}
+
+// issue encrypt resumption secret, peer identity key and issue time to
+// session ticket
+//
+//	Ticket structure:
+//	+-------+--------------------------------------------------+
+//	| NONCE | AEAD(TIME uint64 | SECRET | PEER KEY or zeros)   |
+//	+-------+--------------------------------------------------+
+func (t *tickets) issue(secret []byte, peerKey ed25519.PublicKey) (ticket []byte, err error) {
+	aead, err := newHandshakeAEAD(t.key)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	plain := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+	plain = append(plain, secret...)
+	if peerKey != nil {
+		plain = append(plain, peerKey...)
+	} else {
+		plain = append(plain, make([]byte, ed25519.PublicKeySize)...)
+	}
+	ticket = aead.Seal(nonce, nonce, plain, nil)
+	return
+}
+
+// open decrypt session ticket and return resumption secret and peer
+// identity key, peer key is nil if ticket issued in legacy handshake
+func (t *tickets) open(ticket []byte, now time.Time) (secret []byte,
+	peerKey ed25519.PublicKey, err error) {
+
+	aead, err := newHandshakeAEAD(t.key)
+	if err != nil {
+		return
+	}
+	if len(ticket) < aead.NonceSize() {
+		err = errTicket
+		return
+	}
+	nonce := ticket[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, ticket[len(nonce):], nil)
+	if err != nil || len(plain) != ticketPlainLen {
+		err = errTicket
+		return
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+	if now.Sub(issued) > ticketLifetime {
+		err = errTicket
+		return
+	}
+	secret = plain[8 : 8+handshakeKeyLen]
+	if key := plain[8+handshakeKeyLen:]; !bytesZero(key) {
+		peerKey = ed25519.PublicKey(key)
+	}
+	return
+}
+
+// strike add ticket to used tickets strike register. It returns false if
+// ticket already used or strike register is full
+func (t *tickets) strike(ticket []byte, now time.Time) bool {
+	id := sha256.Sum256(ticket)
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.used[id]; ok || len(t.used) >= ticketStrikeMax {
+		return false
+	}
+	t.used[id] = now.Add(ticketLifetime)
+	return true
+}
+
+// clean remove expired tickets from strike register
+func (t *tickets) clean(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	for id, expire := range t.used {
+		if now.After(expire) {
+			delete(t.used, id)
+		}
+	}
+}
+
+// add add session ticket to client ticket cache. When cache is full expired
+// tickets removed, and other tickets removed if it is still full
+func (t *tickets) add(addr string, st *sessionTicket) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.cache) >= ticketCacheMax {
+		for a, st := range t.cache {
+			if time.Since(st.time) > ticketLifetime || len(t.cache) >= ticketCacheMax {
+				delete(t.cache, a)
+			}
+		}
+	}
+	t.cache[addr] = st
+}
+
+// take get and remove session ticket from client ticket cache
+func (t *tickets) take(addr string) (st *sessionTicket, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	st, ok = t.cache[addr]
+	if !ok {
+		return
+	}
+	delete(t.cache, addr)
+	if time.Since(st.time) > ticketLifetime {
+		return nil, false
+	}
+	return
+}
+
+// bytesZero return true if all bytes are zero
+func bytesZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// resumptionSecret derive resumption secret from session key
+func resumptionSecret(sessionKey []byte) (secret []byte) {
+	secret = make([]byte, handshakeKeyLen)
+	io.ReadFull(hkdf.New(sha256.New, sessionKey, nil, []byte(resumptionLabel)), secret)
+	return
+}
+
+// issueTicket return new session ticket of channel, or nil if session
+// tickets switched off
+func (tru *Tru) issueTicket(ch *Channel) (ticket []byte) {
+	if tru.noTickets || ch.header.version < protocolVersion6 {
+		return
+	}
+	ticket, err := tru.tickets.issue(resumptionSecret(ch.sessionKey.bytes), ch.peerKey)
+	if err != nil {
+		log.Error.Println("can't issue session ticket:", err)
+	}
+	return
+}
+
+// saveTicket save session ticket received from server to ticket cache
+func (tru *Tru) saveTicket(addr net.Addr, ch *Channel, ticket []byte) {
+	if tru.noTickets || len(ticket) == 0 {
+		return
+	}
+	tru.tickets.add(addr.String(), &sessionTicket{
+		ticket:  ticket,
+		secret:  resumptionSecret(ch.sessionKey.bytes),
+		peerKey: ch.peerKey,
+		time:    time.Now(),
+	})
+}
+
+// resumeBinder return clients proof of resumption secret bound to connection
+// uuid, clients ephemeral public key and ticket
+func resumeBinder(secret []byte, uuid string, client, ticket []byte) []byte {
+	key := make([]byte, handshakeKeyLen)
+	io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(resumeBinderLabel)), key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(uuid))
+	mac.Write(client)
+	mac.Write(ticket)
+	return mac.Sum(nil)
+}
+
+// deriveResume derive finished and session keys from resumption secret and
+// client and server ephemeral public keys
+func (h *handshake) deriveResume(secret, client, server []byte) (err error) {
+	err = h.derive(client, server)
+	if err != nil {
+		return
+	}
+	hash := sha256.New()
+	hash.Write([]byte(resumeProtocol))
+	hash.Write(h.transcript)
+	h.transcript = hash.Sum(nil)
+
+	kdf := hkdf.New(sha256.New, append(append([]byte(nil), secret...), h.keys.session...),
+		h.transcript, []byte(resumeProtocol))
+	for _, key := range []*[]byte{&h.keys.server, &h.keys.session} {
+		if _, err = io.ReadFull(kdf, *key); err != nil {
+			return
+		}
+	}
+	h.keys.client = nil
+	return
+}
+
+// finished return servers proof of resumption secret
+func (h *handshake) finished() []byte {
+	mac := hmac.New(sha256.New, h.keys.server)
+	mac.Write(h.transcript)
+	return mac.Sum(nil)
+}
+
+// resume add session ticket of server address to clients connect packet
+// data. It returns false if there is no ticket
+func (tru *Tru) resume(addr net.Addr, cp *connectPacketData, hs *handshake) (
+	st *sessionTicket, ok bool) {
+
+	if tru.noTickets || tru.version < protocolVersion6 {
+		return
+	}
+	st, ok = tru.tickets.take(addr.String())
+	if !ok {
+		return
+	}
+	cp.data = append(hs.public(), resumeBinder(st.secret, hs.uuid, hs.public(),
+		st.ticket)...)
+	cp.options.handshake = handshakeResume
+	cp.options.ticket = st.ticket
+	return
+}
+
+// serveResume resume session by clients ticket: create server channel and
+// send server answer with new ticket. It returns false if session can't be
+// resumed, so server continues full handshake. Channel connected when first
+// data packet received from client
+func (c *connect) serveResume(tru *Tru, addr net.Addr, cp connectPacketData,
+	header channelHeader) (resumed bool, err error) {
+
+	if tru.noTickets || header.version < protocolVersion6 {
+		return
+	}
+	secret, peerKey, err := tru.tickets.open(cp.options.ticket, time.Now())
+	if err != nil {
+		log.Debugv.Println("can't resume session of", addr.String(), err)
+		return false, nil
+	}
+	hs, err := newHandshake(string(cp.uuid), true)
+	if err != nil {
+		return
+	}
+	client := cp.data[:handshakeKeyLen]
+	hs.suites, hs.suite = cp.options.suites.bytes(), header.suite
+	binder := resumeBinder(secret, hs.uuid, client, cp.options.ticket)
+	if !hmac.Equal(binder, cp.data[handshakeKeyLen:]) {
+		log.Debugv.Println("wrong resume binder from", addr.String())
+		return false, nil
+	}
+	if !tru.tickets.strike(cp.options.ticket, time.Now()) {
+		log.Debugv.Println("session ticket already used by", addr.String())
+		return false, nil
+	}
+	err = hs.deriveResume(secret, client, hs.public())
+	if err != nil {
+		return
+	}
+	resumed = true
+
+	// Authorize client by identity key saved in ticket, rejected client gets
+	// server answer with finished and reject proof
+	cp.data = append(hs.public(), hs.finished()...)
+	cp.options = connectOptions{
+		handshake: handshakeResume,
+		suites:    CipherSuites{header.suite},
+	}
+	err = tru.authorize(addr, peerKey, nil)
+	if err != nil {
+		c.writeReject(tru, addr, header, statusConnectServerAnswer,
+			hs.keys.session, cp)
+		return
+	}
+
+	// Create tru channel
+	ch, err := tru.newChannel(addr, header, true)
+	if err != nil {
+		return
+	}
+	err = ch.setPacketKey(hs.keys.session)
+	if err != nil {
+		return
+	}
+	ch.peerKey, ch.resumed = peerKey, true
+	ch.connectPending.Store(true)
+
+	// Send server answer with finished and new ticket
+	cp.extended = true
+	cp.options.connID = header.connID
+	cp.options.ticket = tru.issueTicket(ch)
+	data, err := cp.MarshalBinary()
+	if err != nil {
+		return
+	}
+	data, err = ch.newPacket().SetStatus(statusConnectServerAnswer).
+		SetData(data).MarshalBinary()
+	if err != nil {
+		return
+	}
+	c.addAnswer(addr, hs.uuid, statusConnectServerAnswer, data)
+	err = tru.writeToUnvalidated(data, addr)
+	if err != nil {
+		ch.destroy(fmt.Sprint("channel amplification limit, destroy ", addr.String()))
+	}
+	return
+}
+
+// serveResumeAnswer verify servers finished and create resumed client
+// channel
+func (c *connect) serveResumeAnswer(tru *Tru, addr net.Addr,
+	cp connectPacketData, cd *connectData, header channelHeader) (err error) {
+
+	hs, st := cd.hs, cd.ticket
+	if hs == nil || st == nil || len(cp.data) != handshakeKeyLen+sha256.Size {
+		return errHandshake
+	}
+	hs.suite = header.suite
+	err = hs.deriveResume(st.secret, hs.public(), cp.data[:handshakeKeyLen])
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(hs.finished(), cp.data[handshakeKeyLen:]) {
+		return errHandshake
+	}
+
+	// Server rejected client by authorize function
+	if cp.options.reject != nil {
+		if validReject(hs.keys.session, cp) {
+			cd.err = ErrUnauthorized
+			c.done(cd)
+		}
+		return
+	}
+
+	// Authorize server by identity key saved with ticket
+	err = tru.authorize(addr, st.peerKey, nil)
+	if err != nil {
+		cd.err = err
+		c.done(cd)
+		return
+	}
+
+	// Create tru channel and save new ticket
+	cd.ch, err = tru.newChannel(addr, header)
+	if err != nil {
+		return
+	}
+	err = cd.ch.setPacketKey(hs.keys.session)
+	if err != nil {
+		return
+	}
+	cd.ch.peerKey, cd.ch.resumed = st.peerKey, true
+	tru.saveTicket(addr, cd.ch, cp.options.ticket)
+	c.done(cd)
+	return
+}
+
+// Resumed return true if channel session resumed by session ticket
+func (ch *Channel) Resumed() bool {
+	return ch.resumed
+}
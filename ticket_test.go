@@ -0,0 +1,299 @@
+package tru
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestSessionTicket(t *testing.T) {
+
+	var server, other tickets
+	if err := server.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.init(); err != nil {
+		t.Fatal(err)
+	}
+	identity, _ := GenerateIdentity()
+	peerKey := identity.Public().(ed25519.PublicKey)
+	secret := resumptionSecret([]byte("session key"))
+
+	ticket, err := server.issue(secret, peerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, key, err := server.open(ticket, time.Now())
+	if err != nil {
+		t.Fatalf("can't open ticket: %s", err)
+	}
+	if !bytes.Equal(s, secret) || !key.Equal(peerKey) {
+		t.Error("wrong ticket secret or peer key")
+	}
+
+	// Legacy handshake ticket has no peer key
+	ticket2, _ := server.issue(secret, nil)
+	if _, key, err = server.open(ticket2, time.Now()); err != nil || key != nil {
+		t.Errorf("wrong legacy handshake ticket, peer key %v, err %v", key, err)
+	}
+
+	// Strike register accepts each ticket once until it expires
+	now := time.Now()
+	if !server.strike(ticket, now) || server.strike(ticket, now) {
+		t.Error("wrong used ticket strike")
+	}
+	server.clean(now.Add(2 * ticketLifetime))
+	if !server.strike(ticket, now) {
+		t.Error("expired used ticket not removed")
+	}
+
+	// Wrong tickets
+	if _, _, err = other.open(ticket, time.Now()); err != errTicket {
+		t.Error("ticket of other server accepted")
+	}
+	if _, _, err = server.open(ticket, time.Now().Add(2*ticketLifetime)); err != errTicket {
+		t.Error("expired ticket accepted")
+	}
+	ticket[len(ticket)/2] ^= 1
+	if _, _, err = server.open(ticket, time.Now()); err != errTicket {
+		t.Error("tampered ticket accepted")
+	}
+
+	// Client ticket cache
+	server.add("addr", &sessionTicket{ticket: ticket, time: time.Now()})
+	if _, ok := server.take("addr"); !ok {
+		t.Error("ticket not found in cache")
+	}
+	if _, ok := server.take("addr"); ok {
+		t.Error("ticket used twice")
+	}
+	server.add("addr", &sessionTicket{ticket: ticket,
+		time: time.Now().Add(-2 * ticketLifetime)})
+	if _, ok := server.take("addr"); ok {
+		t.Error("expired ticket found in cache")
+	}
+}
+
+func TestResume(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	for _, legacy := range []LegacyHandshake{false, true} {
+		t.Run(fmt.Sprintf("client legacy %v", legacy), func(t *testing.T) {
+
+			received := make(chan *Channel, 1)
+			reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+				if err == nil {
+					received <- ch
+				}
+				return
+			}
+
+			connected := make(chan *Channel, 1)
+			connectFunc := func(ch *Channel, err error) { connected <- ch }
+
+			server, err := New(0, reader, ConnectFunc(connectFunc),
+				LegacyHandshake(true), log)
+			if err != nil {
+				t.Fatalf("can't start server, err: %s", err)
+			}
+			defer server.Close()
+
+			client, err := New(0, legacy, log)
+			if err != nil {
+				t.Fatalf("can't start client, err: %s", err)
+			}
+			defer client.Close()
+			addr := fmt.Sprintf("127.0.0.1:%d", server.LocalAddr().(*net.UDPAddr).Port)
+
+			// connect to server and check session resumed
+			connect := func(resumed bool) {
+				ch, err := client.Connect(addr)
+				if err != nil {
+					t.Fatalf("can't connect to server, err: %s", err)
+				}
+				defer ch.Close()
+				if ch.Resumed() != resumed {
+					t.Fatalf("wrong client channel resumed %v", ch.Resumed())
+				}
+
+				// Resumed server channel connected by first data packet
+				if resumed {
+					time.Sleep(50 * time.Millisecond)
+					if len(connected) != 0 {
+						t.Fatal("resumed channel connected before data received")
+					}
+				}
+				if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+					t.Fatalf("WriteTo err: %s", err)
+				}
+				var sch *Channel
+				select {
+				case sch = <-received:
+				case <-time.After(5 * time.Second):
+					t.Fatal("packet not received")
+				}
+				if sch.Resumed() != resumed {
+					t.Errorf("wrong server channel resumed %v", sch.Resumed())
+				}
+				select {
+				case cch := <-connected:
+					if cch != sch {
+						t.Error("wrong connected channel")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("channel not connected")
+				}
+				if !bool(legacy) && (!ch.peerKey.Equal(server.identity.Public()) ||
+					!sch.peerKey.Equal(client.identity.Public())) {
+					t.Error("wrong peer identity in resumed session")
+				}
+			}
+
+			// Full handshake, then resumed sessions with new tickets
+			connect(false)
+			connect(true)
+			connect(true)
+
+			// Server can't open tampered ticket and continues full handshake
+			client.tickets.Lock()
+			for _, st := range client.tickets.cache {
+				st.ticket[len(st.ticket)/2] ^= 1
+			}
+			client.tickets.Unlock()
+			connect(false)
+			connect(true)
+		})
+	}
+
+	// Session tickets switched off
+	server, err := New(0, SessionTickets(false), log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+	client, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		ch, err := client.Connect(server.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("can't connect to server, err: %s", err)
+		}
+		if ch.Resumed() {
+			t.Error("session resumed when tickets switched off")
+		}
+		ch.Close()
+	}
+}
+
+func TestResumeReject(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	// Server rejects clients when reject set
+	var reject atomic.Bool
+	authorize := func(addr net.Addr, peerKey ed25519.PublicKey, hello []byte) error {
+		if reject.Load() {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+	server, err := New(0, AuthorizeFunc(authorize), log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+
+	client, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+	addr := server.LocalAddr().String()
+
+	ch, err := client.Connect(addr)
+	if err != nil {
+		t.Fatalf("can't connect to server, err: %s", err)
+	}
+	ch.Close()
+
+	// Resumed session rejected at once
+	reject.Store(true)
+	start := time.Now()
+	if _, err = client.Connect(addr, ConnectTimeout(5*time.Second)); err != ErrUnauthorized {
+		t.Errorf("wrong rejected client error: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("client rejected too late: %v", d)
+	}
+	n := 0
+	server.ForEachChannel(func(*Channel) { n++ })
+	if n != 0 {
+		t.Errorf("server has %d channels of rejected client", n)
+	}
+}
+
+func TestResumeRetransmit(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	// Server drops answers when drop set
+	var drop func(int) bool
+	sconn := newDropConn(t, func(status int) bool { return drop != nil && drop(status) })
+	server, err := New(0, sconn, log)
+	if err != nil {
+		t.Fatalf("can't start server, err: %s", err)
+	}
+	defer server.Close()
+
+	client, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start client, err: %s", err)
+	}
+	defer client.Close()
+	addr := sconn.LocalAddr().String()
+
+	ch, err := client.Connect(addr)
+	if err != nil {
+		t.Fatalf("can't connect to server, err: %s", err)
+	}
+	ch.Close()
+
+	// First resumed server answer lost, client retransmits connect and
+	// server resends the same answer
+	sconn.Lock()
+	drop = dropFirst(statusConnectServerAnswer)
+	sconn.Unlock()
+	ch, err = client.Connect(addr)
+	if err != nil {
+		t.Fatalf("can't resume session, err: %s", err)
+	}
+	defer ch.Close()
+	sconn.Lock()
+	dropped := sconn.dropped[statusConnectServerAnswer]
+	sconn.Unlock()
+	if !ch.Resumed() || dropped != 1 {
+		t.Errorf("wrong resumed %v, dropped %d", ch.Resumed(), dropped)
+	}
+	n := 0
+	server.ForEachChannel(func(sch *Channel) {
+		if sch.Resumed() {
+			n++
+		}
+	})
+	if n != 1 {
+		t.Errorf("wrong number of resumed server channels: %d", n)
+	}
+}
@@ -6,6 +6,7 @@
 package tru
 
 import (
+	"crypto/ed25519"
 	"crypto/rsa"
 	"errors"
 	"flag"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/teonet-go/tru/hotkey"
 	"github.com/teonet-go/tru/teolog"
+	"golang.org/x/net/ipv4"
 )
 
 const truName = "Teonet Reliable UDP (TRU v5)"
@@ -24,23 +26,50 @@ const truVersion = "0.0.18"
 
 // Tru connector
 type Tru struct {
-	conn       net.PacketConn      // Local connection
-	channels   map[string]*Channel // Channels map
-	reader     ReaderFunc          // Global tru reader callback
-	punchcb    PunchFunc           // Punch packet callback
-	connectcb  ConnectFunc         // Connect to this server callback
-	readerCh   chan readerChData   // Reader channel
-	senderCh   chan senderChData   // Sender channel
-	connect    connect             // Connect methods receiver
-	sendDelay  int                 // Common send delay
-	statMsgs   statisticLog        // Statistic log messages
-	statTimer  *time.Timer         // Show statistic timer
-	start      time.Time           // Start time
-	privateKey *rsa.PrivateKey     // Common private key
-	maxDataLen int                 // Max data len in created packets, 0 - maximum UDP len
-	listenStop chan interface{}    // Tru listen wait stop channel
-	hotkey     *hotkey.Hotkey      // Hotkey menu
-	mu         sync.RWMutex        // Channels map mutex
+	conn            net.PacketConn      // Local connection
+	channels        map[string]*Channel // Channels map
+	connIDs         map[uint32]*Channel // Channels by connection ID map
+	reader          ReaderFunc          // Global tru reader callback
+	punchcb         PunchFunc           // Punch packet callback
+	connectcb       ConnectFunc         // Connect to this server callback
+	hellocb         HelloFunc           // Clients hello data callback
+	authorizecb     AuthorizeFunc       // Authorize peer callback
+	readerCh        chan readerChData   // Reader channel
+	senderCh        chan senderChData   // Sender channel
+	connect         connect             // Connect methods receiver
+	sendDelay       int                 // Common send delay
+	statMsgs        statisticLog        // Statistic log messages
+	statTimer       *time.Timer         // Show statistic timer
+	start           time.Time           // Start time
+	privateKey      *rsa.PrivateKey     // Common private key of legacy handshake
+	privateKeyMu    sync.Mutex          // Private key of legacy handshake mutex
+	identity        ed25519.PrivateKey  // Identity key
+	legacyHandshake LegacyHandshake     // Legacy RSA handshake allowed
+	maxDataLen      int                 // Max data len in created packets, 0 - maximum UDP len
+	listenStop      chan interface{}    // Tru listen wait stop channel
+	hotkey          *hotkey.Hotkey      // Hotkey menu
+	ackPolicy       AckPolicy           // Channels acknowledgement policy
+	congestion      CongestionControl   // Channels congestion controller creator
+	retransmit      retransmitScheduler // Channels packets retransmit scheduler
+	receiveWindow   ReceiveWindow       // Channels receive window
+	sendQueueLimit  SendQueueLimit      // Channels send queue limits
+	sharedReader    SharedReader        // One reader goroutine for all channels
+	batch           batchConn           // Batch udp reader and writer or nil
+	noBatch         bool                // Batch udp io switched off
+	noTickets       bool                // Session tickets switched off
+	tickets         tickets             // Session tickets key and cache
+	version         uint8               // Max protocol version
+	cipherSuites    CipherSuites        // Supported cipher suites in preference order
+	rekeyPolicy     RekeyPolicy         // Channels keys update policy
+	statelessRetry  StatelessRetry      // Stateless retry of connect packets
+	retry           retry               // Connect retry cookies and rate limiter
+	amplification   amplification       // Unvalidated addresses amplification limit
+	punchRecv       rateLimiters        // Received punch packets rate limiters
+	punchSend       rateLimiters        // Sent punch packets rate limiters
+	limits          limitCounters       // Anti abuse limits counters
+	connectTimeout  ConnectTimeout      // Default connect timeout
+	connectAttempts ConnectAttempts     // Default connect attempts
+	mu              sync.RWMutex        // Channels map mutex
 }
 
 type Stat bool          // Parameters show statistic type
@@ -67,12 +96,33 @@ var ErrTruClosed = errors.New("tru listner closed")
 //	tru.ReaderFunc:     message receiver callback function
 //	tru.ConnectFunc:    connect to server callback function
 //	tru.PunchFunc:      punch callback function
+//	tru.AuthorizeFunc:  authorize peer callback function
+//	tru.HelloFunc:      clients hello data callback function
+//	ed25519.PrivateKey: identity key
+//	*rsa.PrivateKey:    private key of legacy handshake
 //	*teolog.Teolog:     pointer to teolog
 //	string:             loggers level
 //	teolog.Filter:      loggers filter
 //	tru.StartHotkey:    start hotkey meny
 //	tru.ShowStat:       show statistic
 //	tru.MaxDataLenType: max packet data length
+//	tru.AckPolicy:      channels acknowledgement frequency and delay
+//	tru.CongestionControl: channels congestion controller creator
+//	tru.ReceiveWindow:  channels receive window in packets
+//	tru.SendQueueLimit: channels send queue max packets and bytes
+//	tru.SharedReader:   one reader goroutine for all channels
+//	tru.BatchIO:        batch udp read and write (linux only, default true)
+//	tru.SessionTickets: issue and use session resumption tickets (default true)
+//	tru.ProtocolVersion: max protocol version negotiated with peers
+//	tru.LegacyHandshake: use RSA handshake and accept it from version 6 peers
+//	tru.CipherSuites:   supported cipher suites in preference order
+//	tru.RekeyPolicy:    channels keys update packets, bytes and interval
+//	tru.StatelessRetry: send retry cookie before connect processed
+//	tru.ConnectRateLimit: connect packets rate limit per source ip (default off)
+//	tru.PunchRateLimit: punch packets rate limit per ip
+//	tru.ConnectTimeout: default time to wait connection established
+//	tru.ConnectAttempts: default max number of handshake packet sends
+//	net.PacketConn:     udp connection used instead of listen port
 func New(port int, params ...interface{}) (tru *Tru, err error) {
 
 	// Create tru object
@@ -83,6 +133,9 @@ func New(port int, params ...interface{}) (tru *Tru, err error) {
 	// Parse parameters
 	var logFilter teolog.Filter
 	var logLevel string
+	var version ProtocolVersion
+	var connectRateLimit ConnectRateLimit
+	var punchRateLimit PunchRateLimit
 	for _, p := range params {
 		switch v := p.(type) {
 
@@ -92,6 +145,12 @@ func New(port int, params ...interface{}) (tru *Tru, err error) {
 		case ReaderFunc:
 			tru.reader = v
 
+		// Clients hello data callback
+		case func(*Channel, []byte) []byte:
+			tru.hellocb = v
+		case HelloFunc:
+			tru.hellocb = v
+
 		// Connect to this server callback
 		case func(*Channel, error):
 			tru.connectcb = v
@@ -104,6 +163,12 @@ func New(port int, params ...interface{}) (tru *Tru, err error) {
 		case PunchFunc:
 			tru.punchcb = v
 
+		// Authorize peer callback
+		case func(net.Addr, ed25519.PublicKey, []byte) error:
+			tru.authorizecb = v
+		case AuthorizeFunc:
+			tru.authorizecb = v
+
 		// Teonet logger
 		case *teolog.Teolog:
 			log = v
@@ -128,14 +193,84 @@ func New(port int, params ...interface{}) (tru *Tru, err error) {
 				tru.StatisticPrint()
 			}
 
-		// Private key
+		// Identity key
+		case ed25519.PrivateKey:
+			tru.identity = v
+
+		// Private key of legacy handshake
 		case *rsa.PrivateKey:
-			// TODO: set private key
+			tru.privateKey = v
 
 		// Set max data length
 		case MaxDataLenType:
 			tru.maxDataLen = int(v)
 
+		// Set acknowledgement policy
+		case AckPolicy:
+			tru.ackPolicy = v
+
+		// Set receive window
+		case ReceiveWindow:
+			tru.receiveWindow = v
+
+		// Set send queue limits
+		case SendQueueLimit:
+			tru.sendQueueLimit = v
+
+		// Set shared reader
+		case SharedReader:
+			tru.sharedReader = v
+
+		// Switch batch udp io
+		case BatchIO:
+			tru.noBatch = !bool(v)
+
+		// Switch off session tickets
+		case SessionTickets:
+			tru.noTickets = !bool(v)
+
+		// Set max protocol version
+		case ProtocolVersion:
+			version = v
+
+		// Switch on legacy handshake
+		case LegacyHandshake:
+			tru.legacyHandshake = v
+
+		// Set cipher suites
+		case CipherSuites:
+			tru.cipherSuites = v
+
+		// Set keys update policy
+		case RekeyPolicy:
+			tru.rekeyPolicy = v
+
+		// Switch on stateless retry
+		case StatelessRetry:
+			tru.statelessRetry = v
+
+		// Set connect rate limit
+		case ConnectRateLimit:
+			connectRateLimit = v
+
+		// Set punch rate limit
+		case PunchRateLimit:
+			punchRateLimit = v
+
+		// Set default connect timeout and attempts
+		case ConnectTimeout:
+			tru.connectTimeout = v
+		case ConnectAttempts:
+			tru.connectAttempts = v
+
+		// Set udp connection
+		case net.PacketConn:
+			tru.conn = v
+
+		// Set congestion controller creator
+		case CongestionControl:
+			tru.congestion = v
+
 		// Wrong parameter
 		default:
 			err = fmt.Errorf("incorrect attribute type '%T'", v)
@@ -150,35 +285,115 @@ func New(port int, params ...interface{}) (tru *Tru, err error) {
 	log.SetFilter(logFilter)
 	log.SetLevel(logLevel)
 
-	// Init tru object
-	tru.listenStop = make(chan interface{})
-	tru.channels = make(map[string]*Channel)
-	tru.connect.connects = make(map[string]*connectData)
-	tru.conn, err = net.ListenPacket("udp", ":"+strconv.Itoa(port))
+	// Set default acknowledgement policy
+	if tru.ackPolicy.Frequency <= 0 {
+		tru.ackPolicy.Frequency = defaultAckFrequency
+	}
+	if tru.ackPolicy.Delay <= 0 {
+		tru.ackPolicy.Delay = defaultAckDelay
+	}
+
+	// Set default receive window
+	if tru.receiveWindow <= 0 {
+		tru.receiveWindow = defaultReceiveWindow
+	}
+
+	// Set default send queue limits
+	if tru.sendQueueLimit.Packets == 0 {
+		tru.sendQueueLimit.Packets = defaultSendQueuePackets
+	}
+	if tru.sendQueueLimit.Bytes == 0 {
+		tru.sendQueueLimit.Bytes = defaultSendQueueBytes
+	}
+
+	// Set default congestion controller
+	if tru.congestion == nil {
+		tru.congestion = NewRenoCongestion
+	}
+
+	// Check protocol version or set latest. Version 5 peers support legacy
+	// handshake only
+	tru.version, err = version.check()
 	if err != nil {
 		return
 	}
+	if tru.version < protocolVersion6 && !tru.legacyHandshake {
+		err = errors.New("protocol version 5 requires legacy handshake")
+		return
+	}
 
-	// Generate privater key or use private key from attr parameters
-	// if param.privateKey == nil {
-	//	param.privateKey, _ = GeneratePrivateKey()
-	// }
-	tru.privateKey, err = GeneratePrivateKey()
+	// Check cipher suites or set default
+	tru.cipherSuites, err = tru.cipherSuites.check()
 	if err != nil {
 		return
 	}
 
+	// Init retry cookies, connect and punch rate limiters and amplification
+	// limit
+	err = tru.retry.init(connectRateLimit)
+	if err != nil {
+		return
+	}
+	tru.punchRecv.init(punchRateLimit.Rate, punchRateLimit.Burst,
+		defaultPunchRate, defaultPunchBurst)
+	tru.punchSend.init(punchRateLimit.Rate, punchRateLimit.Burst,
+		defaultPunchRate, defaultPunchBurst)
+	tru.amplification.init()
+
+	// Init session tickets key and cache
+	err = tru.tickets.init()
+	if err != nil {
+		return
+	}
+
+	// Init tru object
+	tru.listenStop = make(chan interface{})
+	tru.channels = make(map[string]*Channel)
+	tru.connIDs = make(map[uint32]*Channel)
+	tru.connect.connects = make(map[string]*connectData)
+	tru.connect.pending = make(map[string]*handshake)
+	tru.connect.legacy = make(map[string]*Channel)
+	tru.connect.answers = make(map[string]*connectAnswer)
+	tru.retransmit.init(func(ch *Channel, pac *Packet) { ch.retransmit(pac) })
+	if tru.conn == nil {
+		tru.conn, err = net.ListenPacket("udp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return
+		}
+	}
+	if !tru.noBatch {
+		tru.batch = newBatchConn(tru.conn)
+	}
+
+	// Generate identity key, and private key of legacy handshake if they are
+	// not set in parameters
+	if tru.identity == nil {
+		tru.identity, err = GenerateIdentity()
+		if err != nil {
+			return
+		}
+	}
+	if tru.legacyHandshake && tru.privateKey == nil {
+		tru.privateKey, err = GeneratePrivateKey()
+		if err != nil {
+			return
+		}
+	}
+
 	// Start packet reader processing
 	tru.readerCh = make(chan readerChData, chanLen)
 	go tru.readerProccess()
 
 	// Start packet sender processing
-	tru.senderCh = make(chan senderChData, chanLen)
+	tru.senderCh = make(chan senderChData, batchSize)
 	go tru.senderProccess()
 
 	// start listen to incoming udp packets
 	go tru.listen()
 
+	// Start limits cleaner
+	go tru.cleanLimits()
+
 	log.Connect.Println("tru created")
 
 	return
@@ -196,8 +411,9 @@ func (tru *Tru) Close() {
 	log.Debug.Println("close all channels")
 	tru.ForEachChannel(func(ch *Channel) { ch.Close() })
 
-	// Stop listner and statistic
+	// Stop listner, retransmit scheduler and statistic
 	tru.stopListen()
+	tru.retransmit.destroy()
 	tru.StatisticPrintStop()
 	log.Connect.Println("tru closed")
 }
@@ -207,7 +423,7 @@ func (tru *Tru) SetPunchCb(punchcb PunchFunc) {
 	tru.punchcb = punchcb
 }
 
-// SetSendDelay set default (start) clients send delay
+// SetSendDelay set default (start) send delay of legacy congestion controller
 func (tru *Tru) SetSendDelay(delay int) {
 	tru.sendDelay = delay
 }
@@ -235,20 +451,25 @@ func (tru *Tru) LocalPort() int {
 func (tru *Tru) WriteTo(data []byte, addri interface{}) (addr net.Addr, err error) {
 
 	// Resolve UDP address
-	// var addr *net.UDPAddr
+	addr, err = resolveAddr(addri)
+	if err != nil {
+		return
+	}
+
+	// Write data to addr
+	tru.conn.WriteTo(data, addr)
+
+	return
+}
+
+// resolveAddr resolve UDP address from string or return UDP address
+func resolveAddr(addri interface{}) (addr net.Addr, err error) {
 	switch v := addri.(type) {
 	case string:
 		addr, err = net.ResolveUDPAddr("udp", v)
-		if err != nil {
-			return
-		}
 	case *net.UDPAddr:
 		addr = v
 	}
-
-	// Write data to addr
-	tru.conn.WriteTo(data, addr)
-
 	return
 }
 
@@ -260,6 +481,11 @@ func (tru *Tru) Hotkey() *hotkey.Hotkey { return tru.hotkey }
 func (tru *Tru) listen() {
 	log.Connect.Println("start listen at", tru.LocalAddr().String())
 
+	if tru.batch != nil {
+		tru.listenBatch()
+		return
+	}
+
 	for {
 		select {
 
@@ -272,15 +498,13 @@ func (tru *Tru) listen() {
 
 		// Read data from tru connect (from UDP port)
 		default:
-			buf := make([]byte, 64*1024)
+			bufp := getBuffer(readBufferLen)
+			buf := *bufp
 			n, addr, err := tru.conn.ReadFrom(buf)
-			if err != nil {
-				// log.Error.Println("ReadFrom error:", err)
-				continue
-			}
-			if n > 0 {
+			if err == nil && n > 0 {
 				tru.serve(n, addr, buf[:n])
 			}
+			putBuffer(bufp)
 		}
 	}
 }
@@ -294,58 +518,47 @@ func (tru *Tru) stopListen() {
 // serve received packet
 func (tru *Tru) serve(n int, addr net.Addr, data []byte) {
 
-	// Unmarshal packet
+	// Unmarshal packet header, packet data refers to read buffer and copied
+	// to pooled buffer when packet stored
 	pac := tru.newPacket()
-	err := pac.UnmarshalBinary(data)
+	err := pac.unmarshalHeader(data)
 	if err != nil {
 		// Wrong packet received from addr
 		log.Error.Printf("got wrong packet %d from %s, data: %s\n", n, addr.String(), data)
 		return
 	}
 
-	// Get channel and process connection packets
-	ch, channelExists := tru.getChannel(addr.String())
-
-	// Process connect or punc packets
-	// if !channelExists ||
-	// 	pac.Status() == statusConnect ||
-	// 	pac.Status() == statusConnectClientAnswer ||
-	// 	pac.Status() == statusConnectDone {
-	// 	// Got connect packet from existing channel, destroy this channel first
-	// 	// becaus client reconnected
-	// 	if channelExists && pac.Status() == statusConnect {
-	// 		ch.destroy(fmt.Sprint("channel reconnect, destroy ", ch.addr.String()))
-	// 	}
-	// 	// Process connection packets
-	// 	err := tru.connect.serve(tru, addr, pac)
-	// 	if channelExists && err != nil {
-	// 		ch.destroy(fmt.Sprint("channel connection error, destroy ", ch.addr.String()))
-	// 	}
-	// 	return
-	// }
+	// Get channel by connection id of long header packets, or by address.
+	// Connection id keeps channel when peer address changed
+	var ch *Channel
+	var channelExists bool
+	if pac.longHeader() {
+		ch, channelExists = tru.getChannelByConnID(pac.connID)
+	} else {
+		ch, channelExists = tru.getChannel(addr.String())
+	}
 
 	// Process connect or punc packets
 	switch pac.Status() {
 
 	// Connect packets
 	case statusConnect, statusConnectServerAnswer, statusConnectClientAnswer, statusConnectDone:
-		// When got connect packet from existing channel we destroy this channel
-		// first becaus client reconnected
-		if channelExists && pac.Status() == statusConnect {
-			ch.destroy(fmt.Sprint("channel reconnect, destroy ", ch.addr.String()))
-		}
 		// Process connection packets
 		err := tru.connect.serve(tru, addr, pac)
 		if channelExists && err != nil {
-			ch.destroy(fmt.Sprint("channel connection error, destroy ", ch.addr.String()))
+			ch.destroy(fmt.Sprint("channel connection error, destroy ", ch.Addr().String()))
 		}
 		return
 
 	// Punch packets: hi level software (f.e. teonet package) use punch packets
 	// to make p2p connection between tru clients
 	case statusPunch:
+		if !tru.punchRecv.allow(addr) {
+			tru.limits.punch.Add(1)
+			return
+		}
 		if tru.punchcb != nil {
-			tru.punchcb(addr, pac.Data())
+			tru.punchcb(addr, append([]byte(nil), pac.Data()...))
 		}
 		return
 
@@ -356,6 +569,12 @@ func (tru *Tru) serve(n int, addr net.Addr, data []byte) {
 		}
 	}
 
+	// Process path validation packets and validate new path when packet
+	// received from other than channels address
+	if pac.longHeader() && ch.servePath(addr, pac) {
+		return
+	}
+
 	// Process regular packets by status
 	switch pac.Status() {
 
@@ -367,35 +586,42 @@ func (tru *Tru) serve(n int, addr net.Addr, data []byte) {
 		log.Debugvvv.Println("got ping answer", ch)
 
 	case statusAck:
-		tt, err := ch.setTripTime(pac.ID())
-		if err != nil {
-			ch.stat.setAckDropReceived()
-			break
-		}
-		ch.stat.setAckReceived()
-		log.Debugvv.Printf("got ack to packet id %d, trip time: %.3f ms", pac.ID(), float64(tt.Microseconds())/1000.0)
-		pac, ok := ch.sendQueue.delete(pac.ID())
-		// Execute packet delivery callback
-		if delivery := pac.Delivery(); ok && delivery != nil {
-			pac.deliveryTimer.Stop()
-			go delivery(pac, nil)
-		}
+		ch.serveAck(pac)
 
 	case statusDisconnect:
-		ch.destroy(fmt.Sprint("channel disconnect received, destroy ", ch.addr.String()))
+		ch.destroy(fmt.Sprint("channel disconnect received, destroy ", ch.Addr().String()))
 		return
 
 	case statusData, statusDataNext:
-		pac.data, err = ch.decryptPacketData(pac.ID(), pac.Data())
+		buf := getBuffer(len(pac.data))
+		epoch := ch.packetEpoch(pac.id)
+		header := data[:pac.HeaderLen()]
+		pac.data, err = ch.decryptPacket((*buf)[:0], header, pac, epoch)
 		if err != nil {
+			ch.stat.setForged()
+			putBuffer(buf)
 			return
 		}
-		dist := pac.distance(ch.expectedID, pac.id)
-		ch.writeToAck(pac)
+		if ch.connectPending.CompareAndSwap(true, false) {
+			tru.connected(ch)
+		}
+		if addr.String() != ch.Addr().String() {
+			ch.pathChallenge(addr)
+		}
+		pac.buf = buf
+		dist := ch.seq.distance(ch.getExpectedID(), pac.id)
+		reordered := dist != 0 || ch.recvQueue.len() > 0
 		switch {
-		// Already processed packet (id < expectedID)
+		// Already processed packet (id < expectedID), duplicate packet
+		// retransmitted or replayed is acknowledged again
 		case dist < 0:
+			ch.stat.setDuplicate()
+			pac.Release()
+		// Packet out of receive window dropped and does not acknowledged
+		case !ch.inReceiveWindow(dist):
 			ch.stat.setDrop()
+			pac.Release()
+			return
 		// Packet with id more than expectedID placed to receive queue and wait
 		// previouse packets
 		case dist > 0:
@@ -403,7 +629,8 @@ func (tru *Tru) serve(n int, addr net.Addr, data []byte) {
 			if !ok {
 				ch.recvQueue.add(pac)
 			} else {
-				ch.stat.setDrop()
+				ch.stat.setDuplicate()
+				pac.Release()
 			}
 		// Valid data packet received (id == expectedID)
 		case dist == 0:
@@ -414,7 +641,7 @@ func (tru *Tru) serve(n int, addr net.Addr, data []byte) {
 				if pac == nil {
 					return
 				}
-				tru.readerCh <- readerChData{ch, pac, nil}
+				ch.toReader(pac)
 				ch.stat.setRecv()
 			}
 			sendToReader(ch, pac)
@@ -422,6 +649,10 @@ func (tru *Tru) serve(n int, addr net.Addr, data []byte) {
 
 			ch.recvQueue.process(ch, sendToReader)
 		}
+		// Send ack after packet processed to acknowledge all received packets
+		// by cumulative expected id and SACK ranges. Out of order packets
+		// acknowledged immediately, other packets depending of ack policy
+		ch.ackReceived(pac, reordered)
 	}
 
 	ch.stat.setLastActivity()
@@ -442,27 +673,43 @@ type readerChData struct {
 	err error
 }
 
-// readerProccess process received tru packets
+// readerProccess process received tru packets of all channels in shared
+// reader mode
 func (tru *Tru) readerProccess() {
 	for r := range tru.readerCh {
+		tru.processReader(r)
+	}
+}
 
-		// Check channel destroyed
-		if r.ch.stat.isDestroyed() {
-			continue
-		}
+// processReader process received packet
+func (tru *Tru) processReader(r readerChData) {
+	tru.execReader(r)
 
-		// Execute channel reader
-		if r.ch.reader != nil {
-			if r.ch.reader(r.ch, r.pac, nil) {
-				continue
-			}
-		}
+	// Packet processed, send window update if receive window opened
+	r.ch.readerBacklog.Add(-1)
+	r.ch.ackWindowUpdate()
+}
+
+// execReader execute channel and global readers
+func (tru *Tru) execReader(r readerChData) {
 
-		// Execute global reader
-		if tru.reader != nil {
-			tru.reader(r.ch, r.pac, nil)
+	// Check channel destroyed
+	if r.ch.stat.isDestroyed() {
+		r.pac.Release()
+		return
+	}
+
+	// Execute channel reader
+	if r.ch.reader != nil {
+		if r.ch.reader(r.ch, r.pac, nil) {
+			return
 		}
 	}
+
+	// Execute global reader
+	if tru.reader != nil {
+		tru.reader(r.ch, r.pac, nil)
+	}
 }
 
 type senderChData struct {
@@ -470,24 +717,109 @@ type senderChData struct {
 	pac *Packet
 }
 
+// senderFull return true if sender channel is full
+func (tru *Tru) senderFull() bool {
+	return len(tru.senderCh) >= cap(tru.senderCh)
+}
+
 // senderProccess process sended tru packets
 func (tru *Tru) senderProccess() {
+	b := newSenderBatch()
 	for r := range tru.senderCh {
-
-		// Check channel destroyed
-		if r.ch.stat.isDestroyed() {
-			continue
+		tru.sendPacket(r, b)
+
+		// Get next packets from sender channel without waiting and write
+		// them by one batch
+	batch:
+		for tru.batch != nil && b.n < batchSize {
+			select {
+			case r := <-tru.senderCh:
+				tru.sendPacket(r, b)
+			default:
+				break batch
+			}
 		}
+		tru.writeSenderBatch(b)
+	}
+}
 
-		// Marshal packet
-		data, err := r.pac.MarshalBinary()
-		if err != nil {
-			return
+// senderBatch is batch of packets marshalled to pooled buffers and waiting
+// batch write
+type senderBatch struct {
+	msgs []ipv4.Message // Batch messages, each message has one buffer
+	bufs []*[]byte      // Pooled buffers of batch messages
+	n    int            // Number of messages in batch
+}
+
+// newSenderBatch create new sender batch
+func newSenderBatch() *senderBatch {
+	b := &senderBatch{
+		msgs: make([]ipv4.Message, batchSize),
+		bufs: make([]*[]byte, batchSize),
+	}
+	for i := range b.msgs {
+		b.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return b
+}
+
+// add marshalled packet to sender batch
+func (b *senderBatch) add(data []byte, bufp *[]byte, addr net.Addr) {
+	b.msgs[b.n].Buffers[0] = data
+	b.msgs[b.n].Addr = addr
+	b.bufs[b.n] = bufp
+	b.n++
+}
+
+// writeSenderBatch write sender batch messages and return its buffers to pool
+func (tru *Tru) writeSenderBatch(b *senderBatch) {
+	if b.n == 0 {
+		return
+	}
+	tru.writeBatch(b.msgs[:b.n])
+	for i := 0; i < b.n; i++ {
+		putBuffer(b.bufs[i])
+		b.msgs[i].Buffers[0] = nil
+		b.msgs[i].Addr = nil
+		b.bufs[i] = nil
+	}
+	b.n = 0
+}
+
+// sendPacket marshal packet to pooled buffer and write it to channels addr or
+// add it to sender batch
+func (tru *Tru) sendPacket(r senderChData, b *senderBatch) {
+
+	// Check channel destroyed
+	if r.ch.stat.isDestroyed() {
+		return
+	}
+
+	// Marshal packet
+	bufp := getBuffer(r.pac.Len())
+	data, err := r.pac.AppendBinary((*bufp)[:0])
+	if err != nil {
+		putBuffer(bufp)
+		return
+	}
+
+	// Pace data packets if channels congestion controller is pacer
+	if r.pac.Status()&^statusSplit == statusData {
+		if p, ok := r.ch.congestion().(CongestionPacer); ok {
+			t := p.NextSendTime(len(r.pac.data))
+			if r.ch.pace(r.pac, t, data, bufp) {
+				return
+			}
 		}
+	}
 
-		// Write packet to addr
-		tru.WriteTo(data, r.ch.addr)
+	// Write packet to addr or add it to batch
+	if !tru.batchable(r.ch.Addr()) {
+		tru.WriteTo(data, r.ch.Addr())
+		putBuffer(bufp)
+		return
 	}
+	b.add(data, bufp, r.ch.Addr())
 }
 
 // Logo return tru logo in string format
@@ -0,0 +1,64 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TRU Flow control module
+
+package tru
+
+import "math"
+
+// ReceiveWindow parameter type sets channels receive window: max number of
+// received data packets which wait in receive queue and in reader. The free
+// part of receive window advertised to peer in acks, and peer does not send
+// more packets than advertised window. Zero value sets default.
+type ReceiveWindow int
+
+const (
+	defaultReceiveWindow = 1024           // Default receive window, packets
+	ackNoWindow          = math.MaxUint32 // Window not advertised by peer
+)
+
+// receiveWindow return free part of channels receive window in packets
+func (ch *Channel) receiveWindow() uint32 {
+	w := int(ch.tru.receiveWindow) - ch.recvQueue.len() - int(ch.readerBacklog.Load())
+	if w < 0 {
+		return 0
+	}
+	return uint32(w)
+}
+
+// inReceiveWindow return true if data packet with distance from expected id
+// fits in receive window
+func (ch *Channel) inReceiveWindow(dist int) bool {
+	return dist < int(ch.tru.receiveWindow)
+}
+
+// ackWindowUpdate send ack with window update when receive window opened
+// after small window advertised
+func (ch *Channel) ackWindowUpdate() {
+	// Protocol version 5 peers does not use receive window
+	if ch.header.version < protocolVersion6 {
+		return
+	}
+	half := uint32(ch.tru.receiveWindow / 2)
+
+	ch.ack.Lock()
+	small, id := ch.ack.window < half, ch.ack.id
+	ch.ack.Unlock()
+
+	if !small || ch.receiveWindow() < half {
+		return
+	}
+	log.Debugvv.Println("send window update", ch.Addr().String())
+	ch.writeToAck(id, 0)
+}
+
+// setWindow set peer receive window and wake up writers waiting window
+func (s *sendQueue) setWindow(window uint32) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.window = window
+	s.cond.Broadcast()
+}
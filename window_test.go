@@ -0,0 +1,69 @@
+package tru
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teonet-go/tru/teolog"
+)
+
+func TestReceiveWindow(t *testing.T) {
+
+	log := teolog.New()
+	log.SetLevel(teolog.Info)
+
+	const window = 16
+	const numPackets = 300
+	wait := make(chan interface{})
+	recvPackets := 0
+
+	// Slow reader
+	reader := func(ch *Channel, pac *Packet, err error) (processed bool) {
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+		recvPackets++
+		if recvPackets == numPackets {
+			close(wait)
+		}
+		return
+	}
+
+	tru1, err := New(0, reader, ReceiveWindow(window), log)
+	if err != nil {
+		t.Fatalf("can't start tru1, err: %s", err)
+	}
+	defer tru1.Close()
+
+	tru2, err := New(0, log)
+	if err != nil {
+		t.Fatalf("can't start tru2, err: %s", err)
+	}
+	defer tru2.Close()
+
+	ch, err := tru2.Connect(tru1.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("can't connect to tru1, err: %s", err)
+	}
+
+	// Writer blocks while peer receive window closed, so send queue never
+	// grows more than receive window after first ack received
+	for i := 0; i < numPackets; i++ {
+		if _, err = ch.WriteTo([]byte("some test data")); err != nil {
+			t.Fatalf("WriteTo err: %s", err)
+		}
+		ch.sendQueue.RLock()
+		window, n := ch.sendQueue.window, ch.sendQueue.queue.Len()+ch.sendQueue.pending.Len()
+		ch.sendQueue.RUnlock()
+		if window != ackNoWindow && uint32(n) > window {
+			t.Fatalf("send queue %d exceeds peer window %d", n, window)
+		}
+	}
+
+	select {
+	case <-wait:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("received %d packets from %d", recvPackets, numPackets)
+	}
+}